@@ -19,23 +19,25 @@ const (
 
 type lookup map[string][]byte
 
-type chatLog map[string]chatLogEntry
-
-type chatLogEntry struct {
-	ID       string   `json:"id,omitempty"`
-	Sender   string   `json:"sender,omitempty"`
-	Sent     int64    `json:"sent,omitempty"`
-	Received int64    `json:"received,omitempty"`
-	TTL      int64    `json:"ttl,omitempty"`
-	Data     chatData `json:"data"`
+type chatLog map[string]Message
+
+// Message is an entry of a chat log, Sender is the peer ID of its author
+type Message struct {
+	ID       string      `json:"id,omitempty"`
+	Sender   string      `json:"sender,omitempty"`
+	Sent     int64       `json:"sent,omitempty"`
+	Received int64       `json:"received,omitempty"`
+	TTL      int64       `json:"ttl,omitempty"`
+	Data     MessageData `json:"data"`
+	Pending  bool        `json:"pending,omitempty"` // set for messages in the outbox, which have no storage hash yet
 }
 
 func (cl chatLog) SortedJSON() ([]byte, error) {
 	return json.Marshal(cl.Sorted())
 }
 
-func (cl chatLog) Sorted() []chatLogEntry {
-	var entries []chatLogEntry
+func (cl chatLog) Sorted() []Message {
+	var entries []Message
 	var keys []string
 
 	for k := range cl {
@@ -48,7 +50,7 @@ func (cl chatLog) Sorted() []chatLogEntry {
 	return entries
 }
 
-func (cl *chatLog) AddEntry(entry chatLogEntry) error {
+func (cl *chatLog) AddEntry(entry Message) error {
 	if (entry.Sent == 0) && (entry.Received == 0) {
 		return errors.New("no valid timestamp found")
 	}
@@ -71,18 +73,65 @@ func (cl chatLog) HashInLog(hash string) bool {
 	return false
 }
 
-type chatData struct {
-	Parent    string   `json:"parent,omitempty"`
-	Timestamp int64    `json:"timestamp,omitempty"`
-	Media     []string `json:"media,omitempty"`
-	Message   string   `json:"message,omitempty"`
-	TTL       int64    `json:"ttl,omitempty"`
+// MessageData is the content of a Message, Control is only set for membership changes
+type MessageData struct {
+	Parent    string          `json:"parent,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+	Media     []string        `json:"media,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	TTL       int64           `json:"ttl,omitempty"`
+	Control   *ControlMessage `json:"control,omitempty"`
+}
+
+// ControlMessage describes the membership change of a chat log entry. The keys and peer configuration the change
+// carried are only used by the session.
+type ControlMessage struct {
+	Type  string `json:"type"`            // add_member, leave or remove_member
+	Alias string `json:"alias,omitempty"` // the alias of the added or removed member
+}
+
+// String returns a description of the membership change
+func (c ControlMessage) String() string {
+	switch c.Type {
+	case controlAddMember:
+		return fmt.Sprintf("added %v to the chat", c.Alias)
+	case controlLeave:
+		return "left the chat"
+	case controlRemoveMember:
+		return fmt.Sprintf("removed %v from the chat", c.Alias)
+	default:
+		return c.Type
+	}
+}
+
+// payload is the MessageData sent to peers. A membership change is sent in full under the same JSON key that
+// holds its ControlMessage in the chat log.
+type payload struct {
+	MessageData
+	Control *chatControl `json:"control,omitempty"`
+}
+
+// redacted returns the MessageData of p without key material, so that it can be stored in a chatLog
+func (p payload) redacted() MessageData {
+	d := p.MessageData
+	d.Control = nil
+	if p.Control != nil {
+		d.Control = &ControlMessage{Type: p.Control.Type}
+		if p.Control.Member != nil {
+			d.Control.Alias = p.Control.Member.Alias
+		}
+	}
+	return d
 }
 
 type chat struct {
 	ID       string
 	PeerID   string
 	LastSent string
+	Epoch    int
+	Left     bool
+	Events   []MembershipChange
+	Nickname string
 	Peers    map[string]chatPeer
 	Settings chatSettings
 }
@@ -92,12 +141,44 @@ type chatConfig struct {
 	ID       string
 	PeerID   string
 	LastSent string
+	Epoch    int
+	Left     bool
+	Events   []MembershipChange
+	Nickname string
 	Peers    map[string]chatPeerConfig
 	Settings chatSettings
 }
 
+// ChatInfo describes a chat with its members and membership changes
+type ChatInfo struct {
+	ID       string             `json:"id"`
+	PeerID   string             `json:"peer_id"`
+	Nickname string             `json:"nickname,omitempty"`
+	ReadOnly bool               `json:"read_only"`
+	Members  []Peer             `json:"members"`
+	Events   []MembershipChange `json:"events,omitempty"`
+}
+
+// Peer describes a chat peer, Keys is the number of unused keys left in its lookup
+type Peer struct {
+	ID     string `json:"id"`
+	Alias  string `json:"alias"`
+	Active bool   `json:"active"`
+	Keys   int    `json:"keys"`
+}
+
+// MembershipChange records a change to the members of a chat
+type MembershipChange struct {
+	Type      string `json:"type"`
+	PeerID    string `json:"peer_id"`
+	Alias     string `json:"alias"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type chatSettings struct {
 	MaxTTL int64
+	Cipher CipherType
+	KDF    kdfParams
 }
 
 // uniqueChatIDsFromPaths takes a lists of paths from and a profile ID and strips out unique ChatID
@@ -105,14 +186,15 @@ type chatSettings struct {
 func uniqueChatIDsFromPaths(list []string, profileID string) (ids []string) {
 	idMap := make(map[string]struct{})
 	for _, l := range list {
-		if strings.Contains(l, profileID) {
-			s := strings.Split(l, "/")
+		s := strings.Split(l, "/")
+		if len(s) > 2 && s[2] == profileID {
 			idMap[s[1]] = struct{}{}
 		}
 	}
 	for id := range idMap {
 		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 	return
 }
 
@@ -189,6 +271,10 @@ func (config chatConfig) Chat() (chat, error) {
 		ID:       config.ID,
 		PeerID:   config.PeerID,
 		LastSent: config.LastSent,
+		Epoch:    config.Epoch,
+		Left:     config.Left,
+		Events:   config.Events,
+		Nickname: config.Nickname,
 		Peers:    make(map[string]chatPeer),
 		Settings: config.Settings,
 	}
@@ -209,11 +295,81 @@ func (c chat) TTL() int64 {
 	return c.Settings.MaxTTL
 }
 
+// kdf returns the argon2 settings negotiated for the chat. Chats created before negotiation use the defaults.
+func (c chat) kdf() kdfParams {
+	if c.Settings.KDF == (kdfParams{}) {
+		return defaultKDFParams()
+	}
+	return c.Settings.KDF
+}
+
+// ActivePeerCount returns the number of peers, including the profile user, that have not left the chat
+func (c chat) ActivePeerCount() int {
+	count := 0
+	for _, p := range c.Peers {
+		if p.Active() {
+			count++
+		}
+	}
+	return count
+}
+
+// ReadOnly returns true if the profile user left the chat or no other active peers remain
+func (c chat) ReadOnly() bool {
+	return c.Left || c.ActivePeerCount() <= 1
+}
+
+// Summary returns a ChatInfo for the chat
+func (c chat) Summary() ChatInfo {
+	summary := ChatInfo{
+		ID:       c.ID,
+		PeerID:   c.PeerID,
+		Nickname: c.Nickname,
+		ReadOnly: c.ReadOnly(),
+		Events:   c.Events,
+	}
+	for _, p := range c.Peers {
+		summary.Members = append(summary.Members, Peer{
+			ID:     p.ID,
+			Alias:  p.Alias,
+			Active: p.Active(),
+		})
+	}
+	sort.Slice(summary.Members, func(i, j int) bool {
+		return summary.Members[i].Alias < summary.Members[j].Alias
+	})
+	return summary
+}
+
+// addEvent records a membership change of type for peer p
+func (c *chat) addEvent(eventType string, p chatPeer, timestamp int64) {
+	c.Events = append(c.Events, MembershipChange{
+		Type:      eventType,
+		PeerID:    p.ID,
+		Alias:     p.Alias,
+		Timestamp: timestamp,
+	})
+}
+
+// peerByFingerprint returns the chatPeer with a matching fingerprint
+func (c chat) peerByFingerprint(fingerprint string) (chatPeer, bool) {
+	for _, p := range c.Peers {
+		if p.Fingerprint != "" && p.Fingerprint == fingerprint {
+			return p, true
+		}
+	}
+	return chatPeer{}, false
+}
+
 func (c chat) Config() (chatConfig, error) {
 	config := chatConfig{
 		ID:       c.ID,
 		PeerID:   c.PeerID,
 		LastSent: c.LastSent,
+		Epoch:    c.Epoch,
+		Left:     c.Left,
+		Events:   c.Events,
+		Nickname: c.Nickname,
 		Peers:    make(map[string]chatPeerConfig),
 		Settings: c.Settings,
 	}
@@ -228,23 +384,37 @@ func (c chat) Config() (chatConfig, error) {
 	return config, nil
 }
 
+// chatPeer is a member of a chat. The ID is local to the device, while the Fingerprint
+// is derived during key generation and is the same for every member of the chat.
+// Tombstone holds the time in unix nanoseconds the peer left or was removed from the chat.
 type chatPeer struct {
-	ID       string
-	Alias    string
-	Strategy strategy
+	ID          string
+	Alias       string
+	Strategy    strategy
+	Fingerprint string
+	Tombstone   int64
 }
 
 type chatPeerConfig struct {
-	ID       string
-	Alias    string
-	Strategy strategyConfig
+	ID          string
+	Alias       string
+	Strategy    strategyConfig
+	Fingerprint string
+	Tombstone   int64
+}
+
+// Active returns false if the peer has left or been removed from the chat
+func (c chatPeer) Active() bool {
+	return c.Tombstone == 0
 }
 
 // Peer converts a chatPeerConfig into a chatPeer
 func (config chatPeerConfig) Peer() (chatPeer, error) {
 	peer := chatPeer{
-		ID:    config.ID,
-		Alias: config.Alias,
+		ID:          config.ID,
+		Alias:       config.Alias,
+		Fingerprint: config.Fingerprint,
+		Tombstone:   config.Tombstone,
 	}
 	s, err := strategyFromConfig(config.Strategy)
 	if err != nil {
@@ -257,8 +427,10 @@ func (config chatPeerConfig) Peer() (chatPeer, error) {
 // Config returns a storage-safe chatPeerConfig and an error
 func (c chatPeer) Config() (chatPeerConfig, error) {
 	config := chatPeerConfig{
-		ID:    c.ID,
-		Alias: c.Alias,
+		ID:          c.ID,
+		Alias:       c.Alias,
+		Fingerprint: c.Fingerprint,
+		Tombstone:   c.Tombstone,
 	}
 	s, err := c.Strategy.Export()
 	config.Strategy = s
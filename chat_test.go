@@ -65,7 +65,7 @@ func TestNewChat(t *testing.T) {
 }
 
 func TestSendReceive(t *testing.T) {
-	ensureCleanDB()
+	defaultStoragePath := useTestDataDir(t)
 	ensureBobCleanDB()
 	ensureAliceCleanDB()
 	bobPassword := "so_damn_secure"
@@ -77,13 +77,13 @@ func TestSendReceive(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	os.Rename(defaultBoltFilePath, bobStoragePath)
+	os.Rename(defaultStoragePath, bobStoragePath)
 
 	if err := NewGenesisProfile(alicePassword); err != nil {
 		t.Fatal(err)
 	}
 
-	os.Rename(defaultBoltFilePath, aliceStoragePath)
+	os.Rename(defaultStoragePath, aliceStoragePath)
 
 	bobSesionOpts := SessionOptions{
 		StorageEngine:   defaultStorageEngine,
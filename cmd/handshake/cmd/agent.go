@@ -0,0 +1,228 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+)
+
+const (
+	agentGet  = "token"
+	agentStop = "stop"
+)
+
+var (
+	agentTTL  int64
+	stopAgent bool
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Keep the profile unlocked for other commands",
+	Long: `Agent asks for the profile password once and creates a session token that
+other handshake commands get over a unix socket that only the current user can
+access. The password is not kept, and the token can not change it. The token
+is revoked once the profile session TTL has passed, on interrupt, or when
+stopped with:
+
+	handshake agent --stop`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if stopAgent {
+			if _, err := agentRequest(agentStop); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if err := runAgent(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.Flags().Int64Var(&agentTTL, "ttl", 0, "seconds to keep the profile unlocked (default is the profile session TTL)")
+	agentCmd.Flags().BoolVar(&stopAgent, "stop", false, "stop a running agent")
+}
+
+// agentSocketPath returns the path of the agent socket for the data dir, in a directory only accessible to
+// the current user
+func agentSocketPath() (string, error) {
+	base := os.Getenv("XDG_RUNTIME_DIR")
+	if base == "" {
+		base = os.TempDir()
+	}
+	dir := filepath.Join(base, fmt.Sprintf("handshake-%d", os.Getuid()))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// fails if the directory was created by another user
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	absDataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(absDataDir))
+	return filepath.Join(dir, fmt.Sprintf("agent-%x.sock", sum[:8])), nil
+}
+
+// agentRequest sends a request to a running agent and returns its response
+func agentRequest(request string) (string, error) {
+	path, err := agentSocketPath()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return "", errors.New("no agent running")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && response == "" {
+		return "", err
+	}
+	return strings.TrimRight(response, "\n"), nil
+}
+
+// agentToken returns the session token held by a running agent and true, or false if no agent is running
+func agentToken() (string, bool) {
+	token, err := agentRequest(agentGet)
+	if err != nil || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// runAgent opens the profile with its password and serves a session token over the agent socket until the TTL
+// passes. The token is revoked when the agent exits.
+func runAgent() error {
+	path, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	if _, err := agentRequest(agentGet); err == nil {
+		return errors.New("an agent is already running")
+	}
+	os.Remove(path)
+
+	password, err := readPassword("password: ")
+	if err != nil {
+		return err
+	}
+	session, err := handshake.NewSession(password, sessionOptions())
+	if err != nil {
+		return err
+	}
+	profile, err := session.GetProfile()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	ttl := profile.Settings.SessionTTL
+	if ttl <= 0 {
+		ttl = handshake.DefaultSessionTTL
+	}
+	if agentTTL > 0 {
+		ttl = agentTTL
+	}
+	token, err := session.CreateSessionToken(ttl)
+	session.Close()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := handshake.RevokeSessionToken(token, sessionOptions()); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	secret := []byte(token)
+	defer func() {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}()
+
+	timer := time.AfterFunc(time.Duration(ttl)*time.Second, func() { l.Close() })
+	defer timer.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			l.Close()
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "agent running for %v\n", time.Duration(ttl)*time.Second)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil
+		}
+		if serveAgent(conn, secret) {
+			l.Close()
+		}
+	}
+}
+
+// serveAgent answers a single request on conn, it returns true if the agent was asked to stop
+func serveAgent(conn net.Conn, secret []byte) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	switch strings.TrimSpace(request) {
+	case agentGet:
+		conn.Write(secret)
+		conn.Write([]byte("\n"))
+	case agentStop:
+		conn.Write([]byte("stopped\n"))
+		return true
+	}
+	return false
+}
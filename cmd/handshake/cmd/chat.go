@@ -0,0 +1,384 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// chatHistory is the number of log entries shown when the chat is opened
+	chatHistory = 50
+)
+
+var pollInterval time.Duration
+
+// chatCmd represents the chat command
+var chatCmd = &cobra.Command{
+	Use:   "chat",
+	Short: "Open an interactive chat",
+	Long: `Chat opens the selected chat in the terminal. New messages are retrieved in
+the background and anything typed at the prompt is sent. The prompt shows the
+connectivity and the number of keys left to send with.
+
+Commands:
+	/unlock  unlock the session after it expired
+	/quit    leave the chat view (ctrl-d works as well)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		chatID, err := currentChatID(session)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fd := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			log.Fatal("chat must be run in a terminal")
+		}
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer terminal.Restore(fd, state)
+
+		ui := newChatUI(session, chatID, terminal.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, ""))
+		if err := ui.run(); err != nil {
+			terminal.Restore(fd, state)
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(chatCmd)
+	chatCmd.Flags().DurationVar(&pollInterval, "interval", 10*time.Second, "time between checks for new messages")
+}
+
+// chatUI renders a chat to a terminal. The lock guards the UI state, the Session is called without it so that
+// a slow poll does not hold up the input line.
+type chatUI struct {
+	sync.Mutex
+	session  *handshake.Session
+	chatID   string
+	term     *terminal.Terminal
+	peerID   string
+	label    string
+	aliases  map[string]string
+	seen     map[string]bool
+	pending  map[string]bool
+	readOnly bool
+	online   bool
+	locked   bool
+	keys     int
+}
+
+func newChatUI(session *handshake.Session, chatID string, term *terminal.Terminal) *chatUI {
+	return &chatUI{
+		session: session,
+		chatID:  chatID,
+		term:    term,
+		aliases: make(map[string]string),
+		seen:    make(map[string]bool),
+		pending: make(map[string]bool),
+		online:  true,
+	}
+}
+
+// run shows the chat history and reads input lines until the user quits
+func (ui *chatUI) run() error {
+	info, err := ui.session.ChatInfo(ui.chatID)
+	if err != nil {
+		return err
+	}
+	history, err := ui.session.Messages(ui.chatID)
+	if err != nil {
+		return err
+	}
+	ui.session.ReleaseStorage()
+	ui.Lock()
+	ui.setInfo(info)
+	ui.render(history, chatHistory)
+	ui.updatePrompt()
+	ui.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ui.poll()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ui.poll()
+			}
+		}
+	}()
+
+	for {
+		line, err := ui.term.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch line {
+		case "":
+		case "/quit":
+			return nil
+		case "/unlock":
+			ui.unlock()
+		default:
+			ui.send(line)
+		}
+	}
+}
+
+// setInfo updates the aliases, read-only state and remaining keys of the chat from c
+func (ui *chatUI) setInfo(c handshake.ChatInfo) {
+	ui.peerID = c.PeerID
+	ui.readOnly = c.ReadOnly
+	ui.label = c.Nickname
+	if ui.label == "" {
+		ui.label = c.ID[:8]
+	}
+	for _, m := range c.Members {
+		ui.aliases[m.ID] = m.Alias
+		if m.ID == c.PeerID {
+			ui.keys = m.Keys
+		}
+	}
+}
+
+// poll retrieves new messages and updates the connectivity indicator
+func (ui *chatUI) poll() {
+	ui.Lock()
+	locked := ui.locked
+	ui.Unlock()
+	if locked {
+		return
+	}
+	// queued messages are sent first, those that still can't be sent stay pending
+	_, flushErr := ui.session.FlushOutbox(ui.chatID)
+	report, err := ui.session.RetrieveReport(ui.chatID)
+	var info handshake.ChatInfo
+	if err == nil {
+		info, err = ui.session.ChatInfo(ui.chatID)
+	}
+	// other commands can use the data dir until the next poll or send
+	ui.session.ReleaseStorage()
+	ui.Lock()
+	defer ui.Unlock()
+	// the queued messages of a chat that became read-only are dropped
+	if errors.Is(flushErr, handshake.ErrChatReadOnly) {
+		ui.printf("%v", flushErr)
+	}
+	if err != nil {
+		ui.handleError(err)
+		return
+	}
+	ui.online = reachable(report.Peers)
+	ui.render(report.Messages, 0)
+	ui.setInfo(info)
+	ui.updatePrompt()
+}
+
+// reachable reports whether at least one peer could be checked for new messages, or there were no peers to check
+func reachable(results []handshake.PeerResult) bool {
+	for _, r := range results {
+		if r.Status != handshake.StatusNetworkError {
+			return true
+		}
+	}
+	return len(results) == 0
+}
+
+// send sends text as a message to the chat
+func (ui *chatUI) send(text string) {
+	ui.Lock()
+	if ui.locked {
+		ui.printf("the session is locked, type /unlock")
+		ui.Unlock()
+		return
+	}
+	if ui.readOnly {
+		ui.printf("this chat is read-only")
+		ui.Unlock()
+		return
+	}
+	ui.Unlock()
+	err := ui.session.Touch()
+	var messages []handshake.Message
+	if err == nil {
+		messages, err = ui.session.Send(ui.chatID, handshake.MessageData{Message: text})
+	}
+	var info handshake.ChatInfo
+	var infoErr error
+	if err == nil {
+		info, infoErr = ui.session.ChatInfo(ui.chatID)
+	}
+	ui.session.ReleaseStorage()
+	ui.Lock()
+	defer ui.Unlock()
+	if errors.Is(err, handshake.ErrSessionExpired) {
+		ui.handleError(err)
+		return
+	}
+	if errors.Is(err, handshake.ErrMessagePending) {
+		ui.handleError(err)
+		ui.printf("message queued, it is sent once the chat is reachable: %v", errors.Unwrap(err))
+		ui.render(messages, 0)
+		return
+	}
+	if err != nil {
+		ui.handleError(err)
+		ui.printf("message not sent: %v", err)
+		return
+	}
+	ui.online = true
+	ui.render(messages, 0)
+	if infoErr == nil {
+		ui.setInfo(info)
+	}
+	ui.updatePrompt()
+}
+
+// unlock asks for the password and unlocks an expired session
+func (ui *chatUI) unlock() {
+	password, err := ui.term.ReadPassword("password: ")
+	if err != nil {
+		return
+	}
+	// failed attempts are delayed, so the UI is not locked while the Session checks the password
+	err = ui.session.Unlock(password)
+	ui.Lock()
+	defer ui.Unlock()
+	if err != nil {
+		ui.printf("%v", err)
+		return
+	}
+	ui.locked = false
+	ui.updatePrompt()
+}
+
+// handleError updates the indicators for an error returned by the Session
+func (ui *chatUI) handleError(err error) {
+	if errors.Is(err, handshake.ErrSessionExpired) {
+		if !ui.locked {
+			ui.printf("the session expired, type /unlock")
+		}
+		ui.locked = true
+	} else {
+		ui.online = false
+	}
+	ui.updatePrompt()
+}
+
+// render prints the entries of the sorted chat log that were not shown yet. Pending entries are printed with
+// a marker and printed again once they are sent. If limit is greater than 0, only the last limit entries are
+// printed.
+func (ui *chatUI) render(entries []handshake.Message, limit int) {
+	var unseen []handshake.Message
+	for _, e := range entries {
+		shown := ui.seen
+		if e.Pending {
+			shown = ui.pending
+		}
+		if !shown[e.ID] {
+			shown[e.ID] = true
+			unseen = append(unseen, e)
+		}
+	}
+	if limit > 0 && len(unseen) > limit {
+		unseen = unseen[len(unseen)-limit:]
+	}
+	for _, e := range unseen {
+		timeStamp := time.Unix(e.Sent/1000000000, 0).Format("15:04:05")
+		alias := ui.aliases[e.Sender]
+		if alias == "" {
+			alias = e.Sender[:6]
+		}
+		if e.Data.Control != nil {
+			ui.printf("%v%v %v %v%v", string(ui.term.Escape.Cyan), timeStamp, alias, e.Data.Control, string(ui.term.Escape.Reset))
+			continue
+		}
+		marker := ""
+		if e.Pending {
+			marker = " (pending)"
+		}
+		ui.printf("%v %v%v%v: %v%v", timeStamp, string(ui.aliasColor(e.Sender, alias)), alias, string(ui.term.Escape.Reset), e.Data.Message, marker)
+	}
+}
+
+// aliasColor returns a color for a sender that stays the same between runs
+func (ui *chatUI) aliasColor(peerID, alias string) []byte {
+	if peerID == ui.peerID {
+		return ui.term.Escape.Green
+	}
+	colors := [][]byte{ui.term.Escape.Yellow, ui.term.Escape.Blue, ui.term.Escape.Magenta, ui.term.Escape.Cyan, ui.term.Escape.Red}
+	h := fnv.New32a()
+	h.Write([]byte(alias))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
+
+// updatePrompt shows the connectivity and key indicators in the prompt
+func (ui *chatUI) updatePrompt() {
+	var status []string
+	switch {
+	case ui.locked:
+		status = append(status, string(ui.term.Escape.Red)+"locked"+string(ui.term.Escape.Reset))
+	case ui.online:
+		status = append(status, string(ui.term.Escape.Green)+"online"+string(ui.term.Escape.Reset))
+	default:
+		status = append(status, string(ui.term.Escape.Red)+"offline"+string(ui.term.Escape.Reset))
+	}
+	switch {
+	case ui.readOnly:
+		status = append(status, "read-only")
+	case ui.keys < handshake.KeyWarningThreshold:
+		status = append(status, fmt.Sprintf("%vkeys:%v%v", string(ui.term.Escape.Yellow), ui.keys, string(ui.term.Escape.Reset)))
+	default:
+		status = append(status, fmt.Sprintf("keys:%v", ui.keys))
+	}
+	ui.term.SetPrompt(fmt.Sprintf("%v [%v] > ", ui.label, strings.Join(status, " ")))
+}
+
+// printf writes a line above the prompt
+func (ui *chatUI) printf(format string, a ...interface{}) {
+	fmt.Fprintf(ui.term, format+"\r\n", a...)
+}
@@ -0,0 +1,171 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// chatRef is the chat selected with --chat, either an ID, a unique ID prefix or a nickname
+var chatRef string
+
+// chatsCmd represents the chats command
+var chatsCmd = &cobra.Command{
+	Use:   "chats",
+	Short: "List and select chats",
+	Long: `Chats lists the chats of the profile and selects the chat used by
+send, receive and log. A chat can be referred to by its ID, a unique
+prefix of its ID or its nickname.`,
+}
+
+var chatsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all chats with their members and remaining keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		chats, err := session.Chats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		current := viper.GetString("ChatID")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tID\tNICKNAME\tMEMBERS (KEYS)\t")
+		for _, c := range chats {
+			marker := ""
+			if c.ID == current {
+				marker = "*"
+			}
+			var members []string
+			for _, m := range c.Members {
+				if m.ID == c.PeerID {
+					continue
+				}
+				if m.Active {
+					members = append(members, fmt.Sprintf("%v (%v)", m.Alias, m.Keys))
+				} else {
+					members = append(members, fmt.Sprintf("%v (left)", m.Alias))
+				}
+			}
+			if c.ReadOnly {
+				members = append(members, "[read-only]")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", marker, c.ID, c.Nickname, strings.Join(members, ", "))
+		}
+		w.Flush()
+	},
+}
+
+var chatsUseCmd = &cobra.Command{
+	Use:   "use <chat>",
+	Short: "Select the chat used by send, receive and log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		chatID, err := resolveChat(session, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		config := Config{ChatID: chatID}
+		if err := config.Save(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("now using chat %v\n", chatID)
+	},
+}
+
+var chatsNickCmd = &cobra.Command{
+	Use:   "nick <chat> [nickname]",
+	Short: "Set a local nickname for a chat, or remove it when no nickname is given",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		chatID, err := resolveChat(session, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		nickname := ""
+		if len(args) > 1 {
+			nickname = args[1]
+		}
+		if err := session.SetChatNickname(chatID, nickname); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(chatsCmd)
+	chatsCmd.AddCommand(chatsListCmd)
+	chatsCmd.AddCommand(chatsUseCmd)
+	chatsCmd.AddCommand(chatsNickCmd)
+	rootCmd.PersistentFlags().StringVar(&chatRef, "chat", "", "chat ID, ID prefix or nickname (default is the chat selected with `chats use`)")
+}
+
+// resolveChat returns the ID of the chat that matches ref exactly, by nickname or by unique ID prefix
+func resolveChat(session *handshake.Session, ref string) (string, error) {
+	chats, err := session.Chats()
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, c := range chats {
+		if c.ID == ref || (c.Nickname != "" && c.Nickname == ref) {
+			return c.ID, nil
+		}
+		if strings.HasPrefix(c.ID, ref) {
+			matches = append(matches, c.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no chat found for %v", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%v matches more than one chat", ref)
+	}
+}
+
+// currentChatID returns the chat selected with --chat, or the chat saved in the config
+func currentChatID(session *handshake.Session) (string, error) {
+	if chatRef != "" {
+		return resolveChat(session, chatRef)
+	}
+	if chatID := viper.GetString("ChatID"); chatID != "" {
+		return chatID, nil
+	}
+	return "", errors.New("no chat selected, run `handshake chats use <chat>` or pass --chat")
+}
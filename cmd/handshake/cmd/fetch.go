@@ -0,0 +1,65 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+)
+
+var (
+	enableFetch  bool
+	disableFetch bool
+)
+
+// fetchCmd represents the fetch command
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Check for new messages without unlocking the profile",
+	Long: `Fetch compares the timestamps at the rendezvous points listed in the
+fetch index with the last retrieved messages and prints how many have news.
+It does not ask for the password and never decrypts anything.
+
+The fetch index is stored unencrypted and is disabled by default. Anyone with
+access to the device can read which rendezvous points are watched, and each
+check queries them from the current network. Enable it with --enable.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if enableFetch || disableFetch {
+			session, err := openSession()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer session.Close()
+			if err := session.SetFetchIndex(enableFetch); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		updates, err := handshake.CheckForUpdates(sessionOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%v rendezvous points with new messages\n", updates)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().BoolVar(&enableFetch, "enable", false, "maintain the fetch index")
+	fetchCmd.Flags().BoolVar(&disableFetch, "disable", false, "securely delete the fetch index and stop maintaining it")
+}
@@ -15,7 +15,6 @@
 package cmd
 
 import (
-	"encoding/hex"
 	"fmt"
 	"log"
 
@@ -34,13 +33,14 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		password := hex.EncodeToString(genRandBytes(16))
-		if err := handshake.NewGenesisProfile(password); err != nil {
+		password, err := readNewPassword()
+		if err != nil {
 			log.Fatal(err)
 		}
-		config := Config{
-			Password: password,
+		if err := handshake.NewGenesisProfileWithOptions(password, sessionOptions()); err != nil {
+			log.Fatal(err)
 		}
+		config := Config{}
 		if err := config.Save(); err != nil {
 			log.Fatal(err)
 		}
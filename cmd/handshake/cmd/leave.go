@@ -0,0 +1,72 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// leaveCmd represents the leave command
+var leaveCmd = &cobra.Command{
+	Use:   "leave",
+	Short: "Leave the current chat",
+	Long: `Leave tells the other members of the current chat that you left and
+securely deletes the keys of the chat. The chat log stays readable.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		chatID, err := currentChatID(session)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		if err := session.LeaveChat(chatID); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// removeCmd represents the remove command
+var removeCmd = &cobra.Command{
+	Use:   "remove <peer id>",
+	Short: "Remove a member from the current chat",
+	Long: `Remove tells the other members of the current chat to stop polling the
+removed member. The removed member still holds the keys it received, so
+create a new chat if it must not read future messages.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		chatID, err := currentChatID(session)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		if err := session.RemoveMember(chatID, args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(leaveCmd)
+	rootCmd.AddCommand(removeCmd)
+}
@@ -17,9 +17,7 @@ package cmd
 import (
 	"log"
 
-	"github.com/nomasters/handshake"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // logCmd represents the log command
@@ -33,25 +31,23 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		password := viper.GetString("Password")
-		chatID := viper.GetString("ChatID")
-		session, err := handshake.NewDefaultSession(password)
+		session, err := openSession()
 		if err != nil {
 			log.Fatal(err)
 		}
-		chatlog, err := session.GetChatlog(chatID)
+		chatID, err := currentChatID(session)
 		if err != nil {
 			log.Fatal(err)
 		}
-		sortedChatLog, err := chatlog.SortedJSON()
-		myPeerID, err := session.GetMyPeerID(chatID)
+		messages, err := session.Messages(chatID)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		if err := logPrinter(sortedChatLog, myPeerID); err != nil {
+		myPeerID, err := session.GetMyPeerID(chatID)
+		if err != nil {
 			log.Fatal(err)
 		}
+		logPrinter(messages, myPeerID)
 	},
 }
 
@@ -24,7 +24,12 @@ import (
 
 	"github.com/nomasters/handshake"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+)
+
+var (
+	strategyFile string
+	useLAN       bool
+	lanPeers     int
 )
 
 // newHandshakeCmd represents the newHandshake command
@@ -38,8 +43,7 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		password := viper.GetString("Password")
-		session, err := handshake.NewDefaultSession(password)
+		session, err := openSession()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -49,74 +53,105 @@ to quickly create a Cobra application.`,
 			log.Fatal("invalid arg, must be joiner or initiator")
 		}
 
+		var def *handshake.StrategyDefinition
+		if strategyFile != "" {
+			d, err := handshake.NewStrategyDefinitionFromFile(strategyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			def = &d
+		}
+
 		switch args[0] {
 		case "joiner":
-			session.NewPeerWithDefaults()
-			share, err := session.ShareHandshakePosition()
-			if err != nil {
+			if def != nil {
+				if err := session.NewPeer(*def); err != nil {
+					log.Fatal(err)
+				}
+			} else if err := session.NewPeerWithDefaults(); err != nil {
 				log.Fatal(err)
 			}
-			shareHex := hex.EncodeToString(share)
-			fmt.Printf(`share this code with the initiator:
+			if useLAN {
+				if err := session.JoinLANHandshake(lanOptions()); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				share, err := session.ShareHandshakePosition()
+				if err != nil {
+					log.Fatal(err)
+				}
+				shareHex := hex.EncodeToString(share)
+				fmt.Printf(`share this code with the initiator:
 	%v
 	
 and add the initiator code below.`, shareHex)
-			fmt.Print("Enter the initiator code: ")
-			reader := bufio.NewReader(os.Stdin)
-			hexText, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			hexText = strings.TrimSpace(hexText)
-			initiatorShare, err := hex.DecodeString(hexText)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if _, err := session.AddPeerToHandshake(initiatorShare); err != nil {
-				log.Fatal(err)
+				fmt.Print("Enter the initiator code: ")
+				reader := bufio.NewReader(os.Stdin)
+				hexText, err := reader.ReadString('\n')
+				if err != nil {
+					log.Fatal(err)
+				}
+				hexText = strings.TrimSpace(hexText)
+				initiatorShare, err := hex.DecodeString(hexText)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if _, err := session.AddPeerToHandshake(initiatorShare); err != nil {
+					log.Fatal(err)
+				}
 			}
 			id, err := session.NewChat()
 			if err != nil {
 				log.Fatal(err)
 			}
 			config := Config{
-				Password: password,
-				ChatID:   id,
+				ChatID: id,
 			}
 			config.Save()
 
 		case "initiator":
-			session.NewInitiatorWithDefaults()
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Print("Enter the joiner code: ")
-			hexText, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-			hexText = strings.TrimSpace(hexText)
-			joinerShare, err := hex.DecodeString(hexText)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if _, err := session.AddPeerToHandshake(joinerShare); err != nil {
-				log.Fatal(err)
-			}
-			share, err := session.GetHandshakePeerConfig(1)
-			if err != nil {
+			if def != nil {
+				if err := session.NewInitiator(*def); err != nil {
+					log.Fatal(err)
+				}
+			} else if err := session.NewInitiatorWithDefaults(); err != nil {
 				log.Fatal(err)
 			}
-			shareHex := hex.EncodeToString(share)
-			fmt.Printf(`share this code with the joiner:
+			if useLAN {
+				if err := session.HostLANHandshake(lanOptions()); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				reader := bufio.NewReader(os.Stdin)
+				fmt.Print("Enter the joiner code: ")
+				hexText, err := reader.ReadString('\n')
+				if err != nil {
+					log.Fatal(err)
+				}
+				hexText = strings.TrimSpace(hexText)
+				joinerShare, err := hex.DecodeString(hexText)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if _, err := session.AddPeerToHandshake(joinerShare); err != nil {
+					log.Fatal(err)
+				}
+				share, err := session.GetHandshakePeerConfig(1)
+				if err != nil {
+					log.Fatal(err)
+				}
+				shareHex := hex.EncodeToString(share)
+				fmt.Printf(`share this code with the joiner:
 	%v
 	
 and add the initiator code below.`, shareHex)
+			}
 			id, err := session.NewChat()
 			if err != nil {
 				log.Fatal(err)
 			}
 			config := Config{
-				Password: password,
-				ChatID:   id,
+				ChatID: id,
 			}
 			config.Save()
 
@@ -127,6 +162,25 @@ and add the initiator code below.`, shareHex)
 	},
 }
 
+// lanOptions returns LANOptions that ask the user to compare the short authentication string
+func lanOptions() handshake.LANOptions {
+	return handshake.LANOptions{
+		Peers: lanPeers,
+		Confirm: func(sas string) bool {
+			fmt.Printf("confirm the other device shows: %v [y/N] ", sas)
+			reader := bufio.NewReader(os.Stdin)
+			answer, err := reader.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			return strings.ToLower(strings.TrimSpace(answer)) == "y"
+		},
+		Rejected: func(err error) {
+			log.Print(err)
+		},
+	}
+}
+
 // reader := bufio.NewReader(os.Stdin)
 // fmt.Print("Enter text: ")
 // text, _ := reader.ReadString('\n')
@@ -134,6 +188,9 @@ and add the initiator code below.`, shareHex)
 
 func init() {
 	rootCmd.AddCommand(newCmd)
+	newCmd.Flags().StringVar(&strategyFile, "strategy", "", "strategy definition file (yaml or json)")
+	newCmd.Flags().BoolVar(&useLAN, "lan", false, "exchange handshake configs over the local network")
+	newCmd.Flags().IntVar(&lanPeers, "peers", 1, "number of joiners an initiator waits for on the local network")
 
 	// Here you will define your flags and configuration settings.
 
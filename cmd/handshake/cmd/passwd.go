@@ -0,0 +1,75 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rotateKey bool
+
+// passwdCmd represents the passwd command
+var passwdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change the profile password",
+	Long: `Passwd asks for a new profile password and re-encrypts the profile with it.
+With --rotate-key the profile key is replaced as well and every chat is
+re-encrypted with it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		password, err := readPassword("password: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		session, err := handshake.NewSession(password, sessionOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+
+		newPassword, err := readNewPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := session.ChangePassword(password, newPassword); err != nil {
+			log.Fatal(err)
+		}
+		// rewrites the config without a plaintext password left by older versions
+		config := Config{
+			ChatID: viper.GetString("ChatID"),
+		}
+		if err := config.Save(); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := agentRequest(agentStop); err == nil {
+			fmt.Println("the agent was stopped, start it again with the new password.")
+		}
+		if rotateKey {
+			if err := session.RotateProfileKey(newPassword); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Println("the profile password has been changed.")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(passwdCmd)
+	passwdCmd.Flags().BoolVar(&rotateKey, "rotate-key", false, "replace the profile key and re-encrypt every chat")
+}
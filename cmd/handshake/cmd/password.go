@@ -0,0 +1,102 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nomasters/handshake"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// readPassword prints prompt to stderr and reads a password from the terminal without echoing it.
+// If stdin is not a terminal, a single line is read instead.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return readLine(os.Stdin)
+	}
+	b, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readLine reads a single line from r without buffering past the newline, so later readers of r
+// see the remaining input
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if len(line) == 0 {
+				return "", err
+			}
+			break
+		}
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// readNewPassword asks for a new password twice and returns it once both entries match
+func readNewPassword() (string, error) {
+	password, err := readPassword("new password: ")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	confirm, err := readPassword("confirm new password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// openSession opens a session with the token of a running agent, or prompts for the password
+func openSession() (*handshake.Session, error) {
+	if token, ok := agentToken(); ok {
+		session, err := handshake.NewSessionFromToken(token, sessionOptions())
+		if err == nil {
+			return session, nil
+		}
+		if !errors.Is(err, handshake.ErrInvalidToken) && !errors.Is(err, handshake.ErrSessionExpired) {
+			return nil, err
+		}
+	}
+	password, err := readPassword("password: ")
+	if err != nil {
+		return nil, err
+	}
+	return handshake.NewSession(password, sessionOptions())
+}
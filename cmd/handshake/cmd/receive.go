@@ -15,11 +15,12 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
 
+	"github.com/fatih/color"
 	"github.com/nomasters/handshake"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // receiveCmd represents the receive command
@@ -33,14 +34,16 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		password := viper.GetString("Password")
-		chatID := viper.GetString("ChatID")
-		session, err := handshake.NewDefaultSession(password)
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		chatID, err := currentChatID(session)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		chatLog, err := session.RetrieveMessages(chatID)
+		report, err := session.RetrieveReport(chatID)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -49,10 +52,25 @@ to quickly create a Cobra application.`,
 		if err != nil {
 			log.Fatal(err)
 		}
-		logPrinter(chatLog, myPeerID)
+		logPrinter(report.Messages, myPeerID)
+		reportPrinter(report.Peers)
 	},
 }
 
+// reportPrinter prints the retrieval status of every peer
+func reportPrinter(results []handshake.PeerResult) {
+	for _, r := range results {
+		switch r.Status {
+		case handshake.StatusUpToDate:
+			fmt.Println(r)
+		case handshake.StatusNewMessages:
+			color.Green(r.String())
+		default:
+			color.Red(r.String())
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(receiveCmd)
 
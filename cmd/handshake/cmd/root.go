@@ -15,21 +15,30 @@
 package cmd
 
 import (
-	"crypto/rand"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/nomasters/handshake"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	yaml "gopkg.in/yaml.v2"
 )
 
-var cfgFile string
+const (
+	// dataDirEnv is the environment variable used when --data-dir is not set
+	dataDirEnv = "HANDSHAKE_DATA_DIR"
+	configName = "handshake.yaml"
+)
+
+var (
+	cfgFile string
+	dataDir string
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -59,7 +68,8 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./handshake.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is handshake.yaml in the data dir)")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "directory for the profile storage and config (default is $"+dataDirEnv+" or $XDG_DATA_HOME/handshake)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -68,13 +78,27 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	if dataDir == "" {
+		dataDir = os.Getenv(dataDirEnv)
+	}
+	if dataDir == "" {
+		dir, err := handshake.DefaultDataDir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		dataDir = dir
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
 	} else {
-		// Search config in home directory with name ".handshake" (without extension).
-		viper.AddConfigPath(".")
-		viper.SetConfigName("handshake")
+		viper.SetConfigFile(configPath())
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
@@ -87,53 +111,47 @@ func initConfig() {
 
 // Config is used to save important settings
 type Config struct {
-	Password string
-	ChatID   string
+	ChatID string
 }
 
-// Save saves a config to disk as a yaml file in the existing directory
+// Save saves a config to disk as a yaml file at configPath
 func (c Config) Save() error {
 	d, err := yaml.Marshal(&c)
 	if err != nil {
 		return err
 	}
-	os.Remove("handshake.yaml")
-	return ioutil.WriteFile("handshake.yaml", d, 0644)
-}
-
-func genRandBytes(l int) []byte {
-	b := make([]byte, l)
-	rand.Read(b)
-	return b
+	path := configPath()
+	os.Remove(path)
+	return ioutil.WriteFile(path, d, 0600)
 }
 
-type Entry struct {
-	ID     string `json:"id"`
-	Sender string `json:"sender"`
-	Sent   int64  `json:"sent"`
-	TTL    int64  `json:"ttl"`
-	Data   ChatData
+// configPath returns the path of the config file, set with --config or in the data dir
+func configPath() string {
+	if cfgFile != "" {
+		return cfgFile
+	}
+	return filepath.Join(dataDir, configName)
 }
 
-type ChatData struct {
-	Timestamp int64  `json:"timestamp"`
-	Message   string `json:"message"`
-	TTL       int64  `json:"ttl"`
+// sessionOptions returns the SessionOptions for storage in the data dir
+func sessionOptions() handshake.SessionOptions {
+	return handshake.NewSessionOptions(dataDir)
 }
 
-func logPrinter(chatLog []byte, myPeerID string) error {
-	var entries []Entry
-	if err := json.Unmarshal(chatLog, &entries); err != nil {
-		return err
-	}
+func logPrinter(entries []handshake.Message, myPeerID string) {
 	for _, entry := range entries {
 		timeStamp := time.Unix(entry.Sent/1000000000, 0).Format("2006-01-02 15:04:05")
 		line := fmt.Sprintf("(%v) %v: %v", timeStamp, entry.Sender[:6], entry.Data.Message)
-		if entry.Sender == myPeerID {
+		if entry.Data.Control != nil {
+			color.Cyan(fmt.Sprintf("(%v) %v %v", timeStamp, entry.Sender[:6], entry.Data.Control))
+			continue
+		}
+		if entry.Pending {
+			color.White(line + " (pending)")
+		} else if entry.Sender == myPeerID {
 			color.Green(line)
 		} else {
 			color.Yellow(line)
 		}
 	}
-	return nil
 }
@@ -15,12 +15,13 @@
 package cmd
 
 import (
-	"fmt"
+	"errors"
 	"log"
 
+	"github.com/fatih/color"
 	"github.com/nomasters/handshake"
+
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // sendCmd represents the send command
@@ -33,26 +34,29 @@ and usage of using your command. For example:
 Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		password := viper.GetString("Password")
-		chatID := viper.GetString("ChatID")
-		session, err := handshake.NewDefaultSession(password)
+		session, err := openSession()
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		body := fmt.Sprintf(`{"message": "%v"}`, args[0])
-
-		chatLog, err := session.SendMessage(chatID, []byte(body))
+		chatID, err := currentChatID(session)
 		if err != nil {
-			fmt.Println("made it here, too")
 			log.Fatal(err)
 		}
+
+		messages, sendErr := session.Send(chatID, handshake.MessageData{Message: args[0]})
+		if sendErr != nil && !errors.Is(sendErr, handshake.ErrMessagePending) {
+			log.Fatal(sendErr)
+		}
 		myPeerID, err := session.GetMyPeerID(chatID)
 		if err != nil {
 			log.Fatal(err)
 		}
-		logPrinter(chatLog, myPeerID)
+		logPrinter(messages, myPeerID)
+		if sendErr != nil {
+			color.Red("%v, it is sent with the next message or by watch", sendErr)
+		}
 	},
 }
 
@@ -0,0 +1,116 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nomasters/handshake"
+	"github.com/spf13/cobra"
+)
+
+var watchOptions handshake.WatchOptions
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print new messages as they arrive",
+	Long: `Watch checks every chat, or only the chat passed with --chat, for new
+messages and prints them until interrupted. Checks are spaced by a random
+interval that grows while no new messages arrive. Chats joined while watching
+are picked up, failed checks are logged and retried, and the session is kept
+unlocked for as long as watch runs. Other commands can use the data dir while
+watch waits between checks.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		session, err := openSession()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		chatID := ""
+		if chatRef != "" {
+			if chatID, err = resolveChat(session, chatRef); err != nil {
+				log.Fatal(err)
+			}
+		}
+		info := make(map[string]handshake.ChatInfo)
+		// chatInfo returns the info of chatID, reloading the chats if it was joined while watching
+		chatInfo := func(chatID string) handshake.ChatInfo {
+			if c, ok := info[chatID]; ok {
+				return c
+			}
+			chats, err := session.Chats()
+			if err != nil {
+				log.Print(err)
+			}
+			for _, c := range chats {
+				info[c.ID] = c
+			}
+			return info[chatID]
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		watchOptions.KeepAlive = true
+		// other commands can use the data dir while watch waits between rounds
+		watchOptions.ReleaseStorage = true
+		events, err := session.Watch(ctx, chatID, watchOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for e := range events {
+			if errors.Is(e.Err, handshake.ErrSessionExpired) {
+				log.Fatal(e.Err)
+			}
+			if e.ChatID == "" {
+				log.Print(e.Err)
+				continue
+			}
+			c := chatInfo(e.ChatID)
+			label := c.Nickname
+			if label == "" {
+				label = e.ChatID
+			}
+			if e.Err != nil {
+				log.Printf("[%v] %v", label, e.Err)
+			}
+			if len(e.Messages) == 0 {
+				continue
+			}
+			fmt.Printf("[%v]\n", label)
+			logPrinter(e.Messages, c.PeerID)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().DurationVar(&watchOptions.Interval, "interval", handshake.DefaultWatchInterval, "time between checks while messages arrive")
+	watchCmd.Flags().DurationVar(&watchOptions.MaxInterval, "max-interval", handshake.DefaultWatchMaxInterval, "longest time between checks when idle")
+	watchCmd.Flags().Float64Var(&watchOptions.Jitter, "jitter", handshake.DefaultWatchJitter, "fraction of the interval that is randomized")
+}
@@ -27,6 +27,14 @@ const (
 	blake2b256length   = 32
 	blake2b256name     = "blake2b-256"
 	lookupHashLength   = 24
+	// defaultKDFTime, defaultKDFMemory and defaultKDFThreads are the minimum argon2 settings
+	// used for lookup generation
+	defaultKDFTime    = 1
+	defaultKDFMemory  = 64 * 1024
+	defaultKDFThreads = 4
+	// maxKDFTime and maxKDFMemory are the strongest argon2 settings this build is willing to run, advertised as its ceiling in a handshake
+	maxKDFTime   = 2
+	maxKDFMemory = 128 * 1024
 )
 
 // NonceType is used for type enumeration for Ciphers Nonces
@@ -47,6 +55,51 @@ const (
 	SecretBox CipherType = iota
 )
 
+// cipherPreference lists the supported CipherTypes ordered from strongest to weakest
+var cipherPreference = []CipherType{SecretBox}
+
+// kdfParams holds the argon2 settings used to generate lookup hashes and keys
+type kdfParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+func defaultKDFParams() kdfParams {
+	return kdfParams{
+		Time:    defaultKDFTime,
+		Memory:  defaultKDFMemory,
+		Threads: defaultKDFThreads,
+	}
+}
+
+func maxKDFParams() kdfParams {
+	return kdfParams{
+		Time:    maxKDFTime,
+		Memory:  maxKDFMemory,
+		Threads: defaultKDFThreads,
+	}
+}
+
+// min returns the weakest value of each setting found in p and o
+func (p kdfParams) min(o kdfParams) kdfParams {
+	if o.Time < p.Time {
+		p.Time = o.Time
+	}
+	if o.Memory < p.Memory {
+		p.Memory = o.Memory
+	}
+	if o.Threads < p.Threads {
+		p.Threads = o.Threads
+	}
+	return p
+}
+
+// atLeast returns true if every setting in p is greater than or equal to o
+func (p kdfParams) atLeast(o kdfParams) bool {
+	return p.Time >= o.Time && p.Memory >= o.Memory && p.Threads >= o.Threads
+}
+
 // Cipher is an interface used for encrypting and decrypting byte slices.
 type cipher interface {
 	Encrypt(data []byte, key []byte) ([]byte, error)
@@ -74,8 +127,20 @@ func genRandBytes(l int) []byte {
 	return b
 }
 
+// wipeBytes overwrites the contents of b with zeros
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // genLookups takes a pepper and entropy []byte, a CipherType, and a count and returns a map[string][]byte for lookup hashes
 func genLookups(pepper [64]byte, entropy [96]byte, cipherType CipherType, count int) (lookup, error) {
+	return genLookupsWithKDF(pepper, entropy, cipherType, count, defaultKDFParams())
+}
+
+// genLookupsWithKDF works like genLookups but uses the argon2 settings in params
+func genLookupsWithKDF(pepper [64]byte, entropy [96]byte, cipherType CipherType, count int, params kdfParams) (lookup, error) {
 	lookups := make(map[string][]byte)
 	if count < 1 {
 		return lookups, errors.New("count must be greater than or equal to 1")
@@ -88,8 +153,11 @@ func genLookups(pepper [64]byte, entropy [96]byte, cipherType CipherType, count
 	default:
 		return lookups, fmt.Errorf("cipher type %v is not implemented for lookup generation", cipherType)
 	}
-	lookupBytes := argon2.IDKey(p, e2, 1, 64*1024, 4, uint32(count*lookupHashLength))
-	keyBytes := argon2.IDKey(e1, e3, 1, 64*1024, 4, uint32(count*keyLength))
+	if !params.atLeast(defaultKDFParams()) {
+		return lookups, errors.New("kdf settings are below the minimum")
+	}
+	lookupBytes := argon2.IDKey(p, e2, params.Time, params.Memory, params.Threads, uint32(count*lookupHashLength))
+	keyBytes := argon2.IDKey(e1, e3, params.Time, params.Memory, params.Threads, uint32(count*keyLength))
 
 	for i := 1; i < count; i++ {
 		lookupStart := (i - 1) * lookupHashLength
@@ -218,12 +286,15 @@ func (s SecretBoxCipher) Decrypt(data []byte, key []byte) ([]byte, error) {
 		} else {
 			chunk = data[i:]
 		}
+		if len(chunk) < secretBoxDecryptionOffset {
+			return nil, ErrDecryptFailed
+		}
 		var n [secretBoxNonceLength]byte
 		copy(n[:], chunk[:secretBoxNonceLength])
 
 		decryptedChunk, ok := secretbox.Open(nil, chunk[secretBoxNonceLength:], &n, &k)
 		if !ok {
-			return nil, errors.New("decrypt failed")
+			return nil, ErrDecryptFailed
 		}
 		decryptedData = append(decryptedData, decryptedChunk...)
 	}
@@ -246,7 +317,7 @@ func (s SecretBoxCipher) genNonce() []byte {
 func (s SecretBoxCipher) share() (peerCipher, error) {
 	return peerCipher{
 		Type:      SecretBox,
-		ChunkSize: secretBoxDefaultChunkSize,
+		ChunkSize: s.chunkSize(),
 	}, nil
 }
 
@@ -254,10 +325,18 @@ func (s SecretBoxCipher) share() (peerCipher, error) {
 func (s SecretBoxCipher) export() (cipherConfig, error) {
 	return cipherConfig{
 		Type:      SecretBox,
-		ChunkSize: secretBoxDefaultChunkSize,
+		ChunkSize: s.chunkSize(),
 	}, nil
 }
 
+// chunkSize returns the configured ChunkSize or the default if none is set
+func (s SecretBoxCipher) chunkSize() int {
+	if s.ChunkSize <= 0 {
+		return secretBoxDefaultChunkSize
+	}
+	return s.ChunkSize
+}
+
 func newCipherFromPeer(config peerCipher) (c cipher, err error) {
 	switch config.Type {
 	case SecretBox:
@@ -2,6 +2,7 @@ package handshake
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -27,3 +28,15 @@ func TestGenLookups(t *testing.T) {
 		}
 	}
 }
+
+func TestDecryptFailed(t *testing.T) {
+	c := newTimeSeriesSBCipher()
+	key := bytes.Repeat([]byte{1}, 32)
+	b, err := c.Encrypt([]byte("hello"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Decrypt(b, bytes.Repeat([]byte{2}, 32)); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("expected ErrDecryptFailed, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package handshake
+
+import "errors"
+
+// Errors returned by the package, possibly wrapped with more context. Use errors.Is to check for them.
+var (
+	// ErrSessionExpired is returned by privileged Session methods once the session TTL has passed or the
+	// session was locked. Unlock must be called to continue using the Session.
+	ErrSessionExpired = errors.New("session expired")
+	// ErrInvalidPassword is returned when a password does not unlock any profile
+	ErrInvalidPassword = errors.New("invalid password")
+	// ErrLoginLocked is returned while logins are refused after too many failed attempts
+	ErrLoginLocked = errors.New("too many failed login attempts")
+	// ErrInvalidToken is returned when a session token is malformed, unknown or was revoked
+	ErrInvalidToken = errors.New("invalid session token")
+	// ErrNoProfile is returned when storage holds no profiles
+	ErrNoProfile = errors.New("no profile found")
+	// ErrNoHandshake is returned by handshake methods when no handshake was started
+	ErrNoHandshake = errors.New("no active handshake")
+	// ErrHandshakeExpired is returned when the active handshake is older than its TTL
+	ErrHandshakeExpired = errors.New("handshake expired")
+	// ErrPeerRejected is returned when a peer config is malformed or incompatible with the active handshake
+	ErrPeerRejected = errors.New("peer rejected")
+	// ErrChatReadOnly is returned when sending to a chat that was left or has no other active members
+	ErrChatReadOnly = errors.New("chat is read-only")
+	// ErrNoKey is returned when a message was encrypted with a key that is not in the peer's lookup,
+	// because it was already used or belongs to another chat
+	ErrNoKey = errors.New("no key")
+	// ErrLookupExhausted is returned when there are not enough keys left to send a message
+	ErrLookupExhausted = errors.New("lookup exhausted")
+	// ErrMessagePending is returned by Send when a message could not be sent yet. It stays in the outbox and is
+	// sent by the next Send or FlushOutbox.
+	ErrMessagePending = errors.New("message pending")
+	// ErrStaleTimestamp is returned when a rendezvous point returns an older payload than was seen before,
+	// which may be a replay
+	ErrStaleTimestamp = errors.New("stale timestamp")
+	// ErrStorageInUse is returned when the storage file stays locked by another process, such as a running watch
+	ErrStorageInUse = errors.New("storage is in use by another process")
+	// ErrNodesUnavailable is returned when none of the configured nodes of a storage could be reached
+	ErrNodesUnavailable = errors.New("no servers available")
+	// ErrDecryptFailed is returned when data can not be decrypted with the given key
+	ErrDecryptFailed = errors.New("decrypt failed")
+)
@@ -0,0 +1,91 @@
+package handshake
+
+// KeyWarningThreshold is the number of unused keys in a lookup below which a KeysLowEvent is sent
+const KeyWarningThreshold = 100
+
+// Event is implemented by every event sent to subscribers: MessageEvent, SendFailedEvent, KeysLowEvent and
+// MembershipEvent
+type Event interface {
+	chat() string
+}
+
+// MessageEvent is sent for every new message retrieved from a peer
+type MessageEvent struct {
+	ChatID  string
+	Message Message
+}
+
+// SendFailedEvent is sent when SendMessage fails to send a message
+type SendFailedEvent struct {
+	ChatID string
+	Err    error
+}
+
+// KeysLowEvent is sent when the lookup of a peer has fewer than KeyWarningThreshold keys left. Once a lookup
+// is exhausted no more messages can be sent by that peer, so a new chat should be created.
+type KeysLowEvent struct {
+	ChatID    string
+	PeerID    string
+	Remaining int
+}
+
+// MembershipEvent is sent when a peer joins, leaves or is removed from a chat
+type MembershipEvent struct {
+	ChatID string
+	MembershipChange
+}
+
+func (e MessageEvent) chat() string    { return e.ChatID }
+func (e SendFailedEvent) chat() string { return e.ChatID }
+func (e KeysLowEvent) chat() string    { return e.ChatID }
+func (e MembershipEvent) chat() string { return e.ChatID }
+
+// Subscribe registers fn to be called with every Event and returns a function that removes the subscription.
+// fn is called synchronously by the Session method that caused the event, so it should return quickly and must
+// not call Session methods.
+func (s *Session) Subscribe(fn func(Event)) (unsubscribe func()) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[int]func(Event))
+	}
+	id := s.nextSubscriber
+	s.nextSubscriber++
+	s.subscribers[id] = fn
+	return func() {
+		s.subscribersMu.Lock()
+		defer s.subscribersMu.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// emit sends e to every subscriber
+func (s *Session) emit(e Event) {
+	s.subscribersMu.Lock()
+	subscribers := make([]func(Event), 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	s.subscribersMu.Unlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// checkKeys sends a KeysLowEvent if remaining is below KeyWarningThreshold
+func (s *Session) checkKeys(chatID, peerID string, remaining int) {
+	if remaining < KeyWarningThreshold {
+		s.emit(KeysLowEvent{ChatID: chatID, PeerID: peerID, Remaining: remaining})
+	}
+}
+
+// setChatWithEvent saves c and sends a MembershipEvent for its latest membership change
+func (s *Session) setChatWithEvent(c chat) error {
+	if err := s.setChat(c.ID, c); err != nil {
+		return err
+	}
+	if len(c.Events) > 0 {
+		s.emit(MembershipEvent{ChatID: c.ID, MembershipChange: c.Events[len(c.Events)-1]})
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package handshake
+
+import (
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-events.boltdb", "bob-events.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	var events []Event
+	unsubscribe := alice.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.RetrieveMessages(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %+v", events)
+	}
+	if e, ok := events[0].(MessageEvent); !ok || e.ChatID != aliceChatID || e.Message.ID == "" {
+		t.Errorf("expected a message event, got %+v", events[0])
+	}
+
+	c, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range l {
+		if len(l) <= KeyWarningThreshold+1 {
+			break
+		}
+		delete(l, k)
+	}
+	if err := alice.setLookup(aliceChatID, c.PeerID, l); err != nil {
+		t.Fatal(err)
+	}
+	events = nil
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "hi"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %+v", events)
+	}
+	if e, ok := events[0].(KeysLowEvent); !ok || e.PeerID != c.PeerID || e.Remaining >= KeyWarningThreshold {
+		t.Errorf("expected a keys low event, got %+v", events[0])
+	}
+
+	n.setOffline(true)
+	events = nil
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "anyone?"}`)); err == nil {
+		t.Fatal("expected sending while offline to fail")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %+v", events)
+	}
+	if e, ok := events[0].(SendFailedEvent); !ok || e.Err == nil {
+		t.Errorf("expected a send failed event, got %+v", events[0])
+	}
+	n.setOffline(false)
+
+	if err := bob.LeaveChat(bobChatID); err != nil {
+		t.Fatal(err)
+	}
+	events = nil
+	if _, err := alice.RetrieveMessages(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %+v", events)
+	}
+	if e, ok := events[0].(MembershipEvent); !ok || e.Type != controlLeave {
+		t.Errorf("expected a membership event, got %+v", events[0])
+	}
+
+	unsubscribe()
+	events = nil
+	if err := alice.LeaveChat(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events after unsubscribing, got %+v", events)
+	}
+}
@@ -0,0 +1,209 @@
+package handshake
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nomasters/hashmap"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// fetchIndexKey is the unencrypted key that lists the rendezvous points checked by CheckForUpdates
+	fetchIndexKey = "global/fetch"
+	// fetchOwnerLength is the length in bytes of the tag that marks the fetch entries of a profile
+	fetchOwnerLength = 8
+	fetchTimeout     = 10 * time.Second
+)
+
+// fetchEntry is a rendezvous point in the global/fetch index and the datestamp of the last message retrieved from
+// it. Owner is a tag derived from the profile key, so the entries of a profile can be replaced without revealing
+// which profile they belong to.
+type fetchEntry struct {
+	URL       string `json:"url"`
+	Datestamp int64  `json:"datestamp"`
+	Owner     string `json:"owner"`
+}
+
+// SetFetchIndex enables or disables the global/fetch index used by CheckForUpdates. The index is stored
+// unencrypted, so anyone with access to the device can see which rendezvous points are watched and how many
+// profiles have chats, and checking for updates queries them from whatever network the device is on. It is
+// disabled by default. Disabling it securely deletes the index.
+func (s *Session) SetFetchIndex(enabled bool) error {
+	if err := s.checkSession(); err != nil {
+		return err
+	}
+	err := s.updateGlobalConfig(func(g *globalConfig) {
+		g.FetchIndex = enabled
+	})
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		s.fetchMu.Lock()
+		defer s.fetchMu.Unlock()
+		return secureDelete(s.storage, fetchIndexKey)
+	}
+	return s.updateFetchIndex()
+}
+
+// fetchOwner returns the tag of the fetch entries of the profile
+func (s *Session) fetchOwner() (string, error) {
+	unlock, err := s.rlockKey()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	h, err := blake2b.New256(s.profile.Key)
+	if err != nil {
+		return "", err
+	}
+	h.Write([]byte(fetchIndexKey))
+	return hex.EncodeToString(h.Sum(nil)[:fetchOwnerLength]), nil
+}
+
+// updateFetchIndex replaces the fetch entries of the profile with the rendezvous points of every active peer in
+// its chats. Entries tagged with one of previousOwners are removed as well. It does nothing if the index is disabled.
+func (s *Session) updateFetchIndex(previousOwners ...string) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	return s.updateFetchIndexLocked(previousOwners...)
+}
+
+// updateFetchIndexLocked is updateFetchIndex for callers that hold fetchMu
+func (s *Session) updateFetchIndexLocked(previousOwners ...string) error {
+	s.mu.RLock()
+	enabled := s.globalConfig.FetchIndex
+	s.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	owner, err := s.fetchOwner()
+	if err != nil {
+		return err
+	}
+	entries, err := getFetchIndex(s.storage)
+	if err != nil {
+		return err
+	}
+	replaced := map[string]bool{owner: true}
+	for _, o := range previousOwners {
+		replaced[o] = true
+	}
+	index := []fetchEntry{}
+	for _, e := range entries {
+		if !replaced[e.Owner] {
+			index = append(index, e)
+		}
+	}
+
+	chatIDs, err := s.chatIDs()
+	if err != nil {
+		return err
+	}
+	for _, chatID := range chatIDs {
+		c, err := s.getChat(chatID)
+		if err != nil {
+			return err
+		}
+		if c.Left {
+			continue
+		}
+		for id, p := range c.Peers {
+			if id == c.PeerID || !p.Active() {
+				continue
+			}
+			h, ok := p.Strategy.Rendezvous.(*hashmapStorage)
+			if !ok {
+				continue
+			}
+			for _, n := range h.ReadNodes {
+				index = append(index, fetchEntry{URL: n.URL, Datestamp: h.Latest, Owner: owner})
+			}
+		}
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	_, err = s.storage.Set(fetchIndexKey, b)
+	return err
+}
+
+// getFetchIndex reads the global/fetch index from storage
+func getFetchIndex(storage storage) ([]fetchEntry, error) {
+	var entries []fetchEntry
+	b, err := storage.Get(fetchIndexKey)
+	if err != nil || len(b) == 0 {
+		return entries, err
+	}
+	err = json.Unmarshal(b, &entries)
+	return entries, err
+}
+
+// CheckForUpdates reads the global/fetch index from the storage in opts and returns the number of rendezvous
+// points that hold a message newer than the last one retrieved. It does not need a password and never decrypts
+// anything, it only compares the signed timestamps of the hashmap payloads. Endpoints that can not be reached are
+// skipped. It returns 0 if the fetch index is disabled.
+func CheckForUpdates(opts SessionOptions) (int, error) {
+	storage, err := newStorage(StorageOptions{Engine: opts.StorageEngine, FilePath: opts.StorageFilePath})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := getFetchIndex(storage)
+	// storage is closed before any network request, so it is not locked while waiting on them
+	storage.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	client := http.Client{Timeout: fetchTimeout}
+	updates := 0
+	for _, i := range shuffledIndexes(len(entries)) {
+		timestamp, err := getHashmapTimestamp(client, entries[i].URL)
+		if err != nil {
+			continue
+		}
+		if timestamp > entries[i].Datestamp {
+			updates++
+		}
+	}
+	return updates, nil
+}
+
+// getHashmapTimestamp returns the signed timestamp of the payload at a hashmap endpoint
+func getHashmapTimestamp(client http.Client, endpoint string) (int64, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	urlHash := getHashFromPath(u.Path)
+	if !isHashmapMultihash(urlHash) {
+		return 0, errors.New("invalid hashmap endpoint")
+	}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	payload, err := hashmap.NewPayloadFromReader(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	pubkey, err := payload.PubKeyBytes()
+	if err != nil {
+		return 0, err
+	}
+	if urlHash != base58Multihash(pubkey) {
+		return 0, errors.New("payload and endpoint hash mismatch")
+	}
+	data, err := payload.GetData()
+	if err != nil {
+		return 0, err
+	}
+	return data.Timestamp, nil
+}
@@ -0,0 +1,67 @@
+package handshake
+
+import (
+	"testing"
+)
+
+func TestCheckForUpdates(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-fetch.boltdb", "bob-fetch.boltdb"}
+	defer removeTestDBs(paths...)
+	aliceOpts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: paths[0]}
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if err := alice.SetFetchIndex(true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := getFetchIndex(alice.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one fetch entry for bob, got %v", entries)
+	}
+	alice.Close()
+
+	checkUpdates := func(expected int) {
+		t.Helper()
+		updates, err := CheckForUpdates(aliceOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updates != expected {
+			t.Errorf("expected %v updates, got %v", expected, updates)
+		}
+	}
+	checkUpdates(0)
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+	checkUpdates(1)
+
+	alice, err = NewSession("alice_password", aliceOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.RetrieveMessages(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	alice.Close()
+	checkUpdates(0)
+
+	alice, err = NewSession("alice_password", aliceOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetFetchIndex(false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = getFetchIndex(alice.storage); err != nil || len(entries) != 0 {
+		t.Errorf("expected the fetch index to be deleted, got %v %v", entries, err)
+	}
+	alice.Close()
+}
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math/big"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
@@ -16,6 +20,8 @@ type role int
 
 const (
 	defaultEntropyBytes = 96
+	// defaultHandshakeTTL is the number of seconds an in-progress handshake is kept before it expires
+	defaultHandshakeTTL = 60 * 60
 	// Version is the hard coded version of handshake-core running
 	Version = "0.0.1"
 )
@@ -31,29 +37,218 @@ type handshake struct {
 	Config      handshakeConfig
 	Position    negotiator
 	PeerTotal   int
+	Expires     int64
 }
 
+// handshakeState allows safe encoding of an in-progress handshake
+type handshakeState struct {
+	Role        role
+	Negotiators []negotiatorConfig
+	Config      handshakeConfig
+	Position    negotiatorConfig
+	PeerTotal   int
+	Expires     int64
+}
+
+// negotiatorConfig allows safe encoding of a negotiator
+type negotiatorConfig struct {
+	Entropy      []byte
+	Alias        string
+	Strategy     strategyConfig
+	SortOrder    int
+	Version      string
+	Capabilities capabilities
+}
+
+// handshakeConfig holds the protocol version and the settings negotiated between all peers
 type handshakeConfig struct {
 	Version string
+	Cipher  CipherType
+	KDF     kdfParams
 }
 
 type negotiator struct {
-	Entropy   []byte
-	Alias     string
-	Strategy  strategy
-	SortOrder int
+	Entropy      []byte
+	Alias        string
+	Strategy     strategy
+	SortOrder    int
+	Version      string
+	Capabilities capabilities
+}
+
+// capabilities advertises what a peer is able to use in a chat. KDF holds the strongest
+// argon2 settings the peer is willing to run for lookup generation.
+type capabilities struct {
+	Ciphers        []CipherType    `json:"ciphers"`
+	StorageEngines []StorageEngine `json:"storage_engines"`
+	KDF            kdfParams       `json:"kdf"`
 }
 
 type peerConfig struct {
-	Entropy    string             `json:"entropy"`
-	Alias      string             `json:"alias"`
-	Config     strategyPeerConfig `json:"config"`
-	Item       int                `json:"item,omitempty"`
-	TotalItems int                `json:"total_items,omitempty"`
+	Version      string             `json:"version"`
+	Capabilities capabilities       `json:"capabilities"`
+	Entropy      string             `json:"entropy"`
+	Alias        string             `json:"alias"`
+	Config       strategyPeerConfig `json:"config"`
+	Item         int                `json:"item,omitempty"`
+	TotalItems   int                `json:"total_items,omitempty"`
+}
+
+// PeerConfig is the position of a peer in a handshake. It is read only by the session and encoded as JSON to be
+// passed between devices.
+type PeerConfig struct {
+	config peerConfig
+}
+
+// Alias returns the alias the peer chose for the handshake
+func (c PeerConfig) Alias() string {
+	return c.config.Alias
+}
+
+// MarshalJSON encodes the PeerConfig in the format returned by ShareHandshakePosition
+func (c PeerConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.config)
+}
+
+// UnmarshalJSON decodes a PeerConfig encoded by MarshalJSON or ShareHandshakePosition
+func (c *PeerConfig) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &c.config)
+}
+
+// localCapabilities returns the capabilities supported by this build of handshake
+func localCapabilities() capabilities {
+	return capabilities{
+		Ciphers:        []CipherType{SecretBox},
+		StorageEngines: []StorageEngine{HashmapEngine, IPFSEngine},
+		KDF:            maxKDFParams(),
+	}
+}
+
+func (c capabilities) hasCipher(t CipherType) bool {
+	for _, cipher := range c.Ciphers {
+		if cipher == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (c capabilities) hasStorageEngine(e StorageEngine) bool {
+	for _, engine := range c.StorageEngines {
+		if engine == e {
+			return true
+		}
+	}
+	return false
+}
+
+// supports checks that a strategy only relies on engines and ciphers listed in the capabilities
+func (c capabilities) supports(config strategyPeerConfig) error {
+	if !c.hasStorageEngine(config.Rendezvous.Type) {
+		return fmt.Errorf("rendezvous engine %v is not supported", config.Rendezvous.Type)
+	}
+	if !c.hasStorageEngine(config.Storage.Type) {
+		return fmt.Errorf("storage engine %v is not supported", config.Storage.Type)
+	}
+	if !c.hasCipher(config.Cipher.Type) {
+		return fmt.Errorf("cipher %v is not supported", config.Cipher.Type)
+	}
+	return nil
+}
+
+// checkVersion returns an error if version v does not speak the same protocol as this build.
+// Versions follow semver, and until 1.0.0 every minor release may break the protocol.
+func checkVersion(v string) error {
+	if v == "" {
+		return errors.New("peer did not provide a protocol version")
+	}
+	peerVersion, err := parseVersion(v)
+	if err != nil {
+		return err
+	}
+	localVersion, err := parseVersion(Version)
+	if err != nil {
+		return err
+	}
+	compatible := peerVersion[0] == localVersion[0]
+	if localVersion[0] == 0 {
+		compatible = compatible && peerVersion[1] == localVersion[1]
+	}
+	if !compatible {
+		return fmt.Errorf("incompatible peer version %v: this build speaks %v", v, Version)
+	}
+	return nil
+}
+
+// parseVersion takes a semver string of the form major.minor.patch and returns its components
+func parseVersion(v string) (version [3]int, err error) {
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return version, fmt.Errorf("invalid version: %v", v)
+	}
+	for i, p := range parts {
+		if version[i], err = strconv.Atoi(p); err != nil {
+			return version, fmt.Errorf("invalid version: %v", v)
+		}
+	}
+	return version, nil
+}
+
+// checkPeerCompatibility validates a peerConfig against the local position. The peer must speak the same
+// protocol version, be able to read the local strategy, and use a strategy the local build can read.
+func (h *handshake) checkPeerCompatibility(config peerConfig) error {
+	if err := checkVersion(config.Version); err != nil {
+		return err
+	}
+	if err := localCapabilities().supports(config.Config); err != nil {
+		return fmt.Errorf("incompatible peer strategy: %w", err)
+	}
+	localStrategy, err := h.Position.Strategy.Share()
+	if err != nil {
+		return err
+	}
+	if err := config.Capabilities.supports(localStrategy); err != nil {
+		return fmt.Errorf("peer can not use local strategy: %w", err)
+	}
+	return nil
 }
 
-// AddPeer takes a peerConfig and adds it to a handshake negotiator slice. It checks for unique Entropy bytes.
+// negotiate selects the strongest settings supported by every negotiator and the local position. Each
+// negotiator advertises the strongest KDF settings it is willing to run as a ceiling, and the KDF is the weakest
+// of those ceilings: the cost only rises as far as every peer allows, and never falls below the default.
+func negotiate(position negotiator, negotiators []negotiator) (config handshakeConfig, err error) {
+	all := append([]negotiator{position}, negotiators...)
+	config.Version = Version
+	config.KDF = all[0].Capabilities.KDF
+	for _, n := range all[1:] {
+		config.KDF = config.KDF.min(n.Capabilities.KDF)
+	}
+	if !config.KDF.atLeast(defaultKDFParams()) {
+		return config, errors.New("peers do not support the minimum kdf settings")
+	}
+	// cipherPreference is ordered from strongest to weakest
+	for _, c := range cipherPreference {
+		common := true
+		for _, n := range all {
+			if !n.Capabilities.hasCipher(c) {
+				common = false
+				break
+			}
+		}
+		if common {
+			config.Cipher = c
+			return config, nil
+		}
+	}
+	return config, errors.New("peers share no common cipher")
+}
+
+// AddPeer takes a peerConfig and adds it to a handshake negotiator slice. It checks for unique Entropy bytes
+// and rejects peers that are running an incompatible protocol version or lack a common set of capabilities.
 func (h *handshake) AddPeer(config peerConfig) error {
+	if err := h.checkPeerCompatibility(config); err != nil {
+		return err
+	}
 	if h.Role == peer {
 		if config.Item == 0 {
 			return errors.New("missing sort order")
@@ -74,6 +269,11 @@ func (h *handshake) AddPeer(config peerConfig) error {
 			return errors.New("duplicate detected, peer must be unique")
 		}
 	}
+	negotiated, err := negotiate(h.Position, append(h.Negotiators, n))
+	if err != nil {
+		return err
+	}
+	h.Config = negotiated
 	h.Negotiators = append(h.Negotiators, n)
 
 	if h.Role == peer {
@@ -89,6 +289,108 @@ func (h *handshake) AddPeer(config peerConfig) error {
 	return nil
 }
 
+// Expired returns true if the handshake is past its expiration time
+func (h *handshake) Expired() bool {
+	return h.Expires > 0 && time.Now().Unix() > h.Expires
+}
+
+// wipe overwrites all entropy held by the handshake
+func (h *handshake) wipe() {
+	wipeBytes(h.Position.Entropy)
+	for _, n := range h.Negotiators {
+		wipeBytes(n.Entropy)
+	}
+}
+
+// State returns a storage-safe handshakeState and an error
+func (h *handshake) State() (handshakeState, error) {
+	state := handshakeState{
+		Role:      h.Role,
+		Config:    h.Config,
+		PeerTotal: h.PeerTotal,
+		Expires:   h.Expires,
+	}
+	position, err := h.Position.Config()
+	if err != nil {
+		return handshakeState{}, err
+	}
+	state.Position = position
+	for _, n := range h.Negotiators {
+		config, err := n.Config()
+		if err != nil {
+			return handshakeState{}, err
+		}
+		state.Negotiators = append(state.Negotiators, config)
+	}
+	return state, nil
+}
+
+// Handshake converts a handshakeState into a handshake
+func (state handshakeState) Handshake() (*handshake, error) {
+	h := handshake{
+		Role:      state.Role,
+		Config:    state.Config,
+		PeerTotal: state.PeerTotal,
+		Expires:   state.Expires,
+	}
+	position, err := state.Position.Negotiator()
+	if err != nil {
+		return nil, err
+	}
+	h.Position = position
+	for _, config := range state.Negotiators {
+		n, err := config.Negotiator()
+		if err != nil {
+			return nil, err
+		}
+		h.Negotiators = append(h.Negotiators, n)
+	}
+	return &h, nil
+}
+
+// Config returns a storage-safe negotiatorConfig and an error
+func (n negotiator) Config() (negotiatorConfig, error) {
+	s, err := n.Strategy.Export()
+	if err != nil {
+		return negotiatorConfig{}, err
+	}
+	return negotiatorConfig{
+		Entropy:      n.Entropy,
+		Alias:        n.Alias,
+		Strategy:     s,
+		SortOrder:    n.SortOrder,
+		Version:      n.Version,
+		Capabilities: n.Capabilities,
+	}, nil
+}
+
+// Negotiator converts a negotiatorConfig into a negotiator
+func (config negotiatorConfig) Negotiator() (negotiator, error) {
+	s, err := strategyFromConfig(config.Strategy)
+	if err != nil {
+		return negotiator{}, err
+	}
+	return negotiator{
+		Entropy:      config.Entropy,
+		Alias:        config.Alias,
+		Strategy:     s,
+		SortOrder:    config.SortOrder,
+		Version:      config.Version,
+		Capabilities: config.Capabilities,
+	}, nil
+}
+
+// newHandshakeFromGob takes a gob encoded handshakeState and returns a handshake and error
+func newHandshakeFromGob(b []byte) (*handshake, error) {
+	var state handshakeState
+	var buffer bytes.Buffer
+	buffer.Write(b)
+	if err := gob.NewDecoder(&buffer).Decode(&state); err != nil {
+		return nil, err
+	}
+	return state.Handshake()
+}
+
 // Share returns JSON encoded bytes of a peerConfig and an error
 func (n negotiator) Share() (b []byte, err error) {
 	config, err := n.PeerConfig()
@@ -108,9 +410,11 @@ func (n negotiator) PeerConfig() (config peerConfig, err error) {
 		return
 	}
 	config = peerConfig{
-		Entropy: base64.StdEncoding.EncodeToString(n.Entropy),
-		Alias:   n.Alias,
-		Config:  stratConfig,
+		Version:      n.Version,
+		Capabilities: n.Capabilities,
+		Entropy:      base64.StdEncoding.EncodeToString(n.Entropy),
+		Alias:        n.Alias,
+		Config:       stratConfig,
 	}
 	return
 }
@@ -209,8 +513,10 @@ type handshakeOptions struct {
 
 func genPosition() negotiator {
 	return negotiator{
-		Entropy: genRandBytes(defaultEntropyBytes),
-		Alias:   genAlias(),
+		Entropy:      genRandBytes(defaultEntropyBytes),
+		Alias:        genAlias(),
+		Version:      Version,
+		Capabilities: localCapabilities(),
 	}
 }
 
@@ -226,7 +532,10 @@ func newHandshake(strategy strategy, opts handshakeOptions) *handshake {
 		Position: position,
 		Config: handshakeConfig{
 			Version: Version,
+			Cipher:  SecretBox,
+			KDF:     defaultKDFParams(),
 		},
+		Expires: time.Now().Unix() + defaultHandshakeTTL,
 	}
 	if h.Role == initiator {
 		h.Negotiators = append(h.Negotiators, position)
@@ -248,14 +557,16 @@ func newHandshakePeerWithDefaults() *handshake {
 	return newHandshake(newDefaultStrategy(), opts)
 }
 
+// npa is the NATO phonetic alphabet, used for aliases and short authentication strings
+var npa = []string{
+	"alfa", "bravo", "charlie", "delta", "echo", "foxtrot", "golf",
+	"hotel", "india", "juliett", "kilo", "lima", "mike", "november",
+	"oscar", "papa", "quebec", "romeo", "sierra", "tango", "uniform",
+	"victor", "whiskey", "x-ray", "yankee", "zulu",
+}
+
 func genAlias() string {
 	var aliasSlice []string
-	npa := []string{
-		"alfa", "bravo", "charlie", "delta", "echo", "foxtrot", "golf",
-		"hotel", "india", "juliett", "kilo", "lima", "mike", "november",
-		"oscar", "papa", "quebec", "romeo", "sierra", "tango", "uniform",
-		"victor", "whiskey", "x-ray", "yankee", "zulu",
-	}
 	for i := 0; i < 3; i++ {
 		x, _ := rand.Int(rand.Reader, big.NewInt(int64(len(npa))))
 		aliasSlice = append(aliasSlice, npa[x.Int64()])
@@ -272,6 +583,8 @@ func newNegotiatorFromPeerConfig(config peerConfig) (n negotiator, err error) {
 	}
 	n.Alias = config.Alias
 	n.SortOrder = config.Item
+	n.Version = config.Version
+	n.Capabilities = config.Capabilities
 	return
 }
 
@@ -25,3 +25,79 @@ func TestNewHandshake(t *testing.T) {
 	}
 	t.Log(h2)
 }
+
+func TestAddPeerCompatibility(t *testing.T) {
+	h := newHandshakePeerWithDefaults()
+	pc, err := h.Position.PeerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incompatible := pc
+	incompatible.Version = "0.1.0"
+	h2 := newHandshakeInitiatorWithDefaults()
+	if err := h2.AddPeer(incompatible); err == nil {
+		t.Error("expected incompatible version to be rejected")
+	}
+
+	noCipher := pc
+	noCipher.Capabilities.Ciphers = []CipherType{}
+	if err := h2.AddPeer(noCipher); err == nil {
+		t.Error("expected peer without a common cipher to be rejected")
+	}
+
+	tooWeak := pc
+	tooWeak.Capabilities.KDF = defaultKDFParams()
+	tooWeak.Capabilities.KDF.Memory--
+	if err := h2.AddPeer(tooWeak); err == nil {
+		t.Error("expected peer below the minimum kdf settings to be rejected")
+	}
+
+	weak := pc
+	weak.Capabilities.KDF = defaultKDFParams()
+	if err := h2.AddPeer(weak); err != nil {
+		t.Fatal(err)
+	}
+	if h2.Config.KDF != defaultKDFParams() {
+		t.Errorf("expected weakest common kdf settings, got %+v", h2.Config.KDF)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	position := genPosition()
+	peer := genPosition()
+
+	config, err := negotiate(position, []negotiator{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.KDF != maxKDFParams() {
+		t.Errorf("expected max kdf settings when every peer supports them, got %+v", config.KDF)
+	}
+	if config.Cipher != SecretBox {
+		t.Errorf("expected %v cipher, got %v", SecretBox, config.Cipher)
+	}
+
+	weaker := genPosition()
+	weaker.Capabilities.KDF = maxKDFParams()
+	weaker.Capabilities.KDF.Time = defaultKDFTime
+	config, err = negotiate(position, []negotiator{peer, weaker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.KDF != weaker.Capabilities.KDF {
+		t.Errorf("expected the weakest peer ceiling %+v, got %+v", weaker.Capabilities.KDF, config.KDF)
+	}
+
+	weaker.Capabilities.KDF.Memory = defaultKDFMemory / 2
+	if _, err := negotiate(position, []negotiator{peer, weaker}); err == nil {
+		t.Error("expected a peer ceiling below the minimum kdf settings to be rejected")
+	}
+
+	// supports only checks the cipher of a strategy, so a peer can pass AddPeer's compatibility check while
+	// sharing no cipher in its advertised capabilities
+	peer.Capabilities.Ciphers = []CipherType{}
+	if _, err := negotiate(position, []negotiator{peer}); err == nil {
+		t.Error("expected peers without a common cipher to be rejected")
+	}
+}
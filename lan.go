@@ -0,0 +1,436 @@
+package handshake
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// DefaultLANDiscoveryPort is the UDP port used to announce and discover LAN handshakes
+	DefaultLANDiscoveryPort = 47821
+	// DefaultLANTimeout is the default time allowed for a LAN handshake to complete
+	DefaultLANTimeout = 5 * time.Minute
+	// lanAnnouncePrefix identifies handshake announcements and the version of the LAN protocol
+	lanAnnouncePrefix   = "handshake-lan/2"
+	lanAnnounceInterval = time.Second
+	lanMaxFrameSize     = 64 * 1024
+	// lanSASWords is the length of the short authentication string, 8 NATO words are about 37 bits
+	lanSASWords = 8
+)
+
+// LANOptions holds the settings for running a handshake over the local network
+type LANOptions struct {
+	// Peers is the number of joiners an initiator waits for before sharing configs
+	Peers int
+	// DiscoveryPort is the UDP port used for broadcast announcements
+	DiscoveryPort int
+	// Timeout is the maximum duration of the exchange
+	Timeout time.Duration
+	// Confirm is called with the short authentication string of each connection. Both devices must
+	// display the same string; returning false aborts the connection.
+	Confirm func(sas string) bool
+	// Rejected is called when an initiator drops a joiner whose config was rejected, and may be nil. The
+	// initiator keeps waiting for other joiners.
+	Rejected func(err error)
+}
+
+func (opts LANOptions) withDefaults() LANOptions {
+	if opts.DiscoveryPort == 0 {
+		opts.DiscoveryPort = DefaultLANDiscoveryPort
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultLANTimeout
+	}
+	if opts.Peers == 0 {
+		opts.Peers = 1
+	}
+	return opts
+}
+
+// HostLANHandshake runs the initiator side of the ActiveHandshake over the local network. It announces the
+// handshake with UDP broadcast and waits for opts.Peers joiners to connect over TCP. Once every joiner has
+// been added, each one is sent the configs needed to complete the handshake.
+func (s *Session) HostLANHandshake(opts LANOptions) error {
+	opts = opts.withDefaults()
+	l, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	done := make(chan struct{})
+	defer close(done)
+	go announceLAN(port, opts.DiscoveryPort, done)
+
+	return s.hostLAN(l, opts)
+}
+
+// JoinLANHandshake runs the peer side of the ActiveHandshake over the local network. It waits for an
+// initiator announcement, connects to it and exchanges configs until all peers have been received.
+func (s *Session) JoinLANHandshake(opts LANOptions) error {
+	opts = opts.withDefaults()
+	addr, err := discoverLAN(opts.DiscoveryPort, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	return s.joinLAN(addr, opts)
+}
+
+func (s *Session) hostLAN(l net.Listener, opts LANOptions) error {
+	role, err := s.handshakeRole()
+	if err != nil {
+		return err
+	}
+	if role != initiator {
+		return errors.New("only an initiator can host a LAN handshake")
+	}
+	deadline := time.Now().Add(opts.Timeout)
+	if tl, ok := l.(*net.TCPListener); ok {
+		tl.SetDeadline(deadline)
+	}
+
+	var channels []*lanChannel
+	defer func() {
+		for _, ch := range channels {
+			ch.Close()
+		}
+	}()
+	for len(channels) < opts.Peers {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if !isLocalLink(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(deadline)
+		ch, err := newLANChannel(conn, true, opts.Confirm)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		share, err := ch.ReadFrame()
+		if err != nil {
+			ch.Close()
+			continue
+		}
+		if _, err := s.AddPeerToHandshake(share); err != nil {
+			ch.Close()
+			if !errors.Is(err, ErrPeerRejected) {
+				return err
+			}
+			if opts.Rejected != nil {
+				opts.Rejected(err)
+			}
+			continue
+		}
+		channels = append(channels, ch)
+	}
+
+	// with two parties the joiner only needs the initiator config, otherwise it needs every config
+	total := s.GetHandshakePeerTotal()
+	sortNumbers := []int{1}
+	if total > 2 {
+		sortNumbers = sortNumbers[:0]
+		for i := 1; i <= total; i++ {
+			sortNumbers = append(sortNumbers, i)
+		}
+	}
+	var configs []json.RawMessage
+	for _, i := range sortNumbers {
+		config, err := s.GetHandshakePeerConfig(i)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, config)
+	}
+	b, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	for _, ch := range channels {
+		if err := ch.WriteFrame(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) joinLAN(addr string, opts LANOptions) error {
+	role, err := s.handshakeRole()
+	if err != nil {
+		return err
+	}
+	if role != peer {
+		return errors.New("only a peer can join a LAN handshake")
+	}
+	share, err := s.ShareHandshakePosition()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp4", addr, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	ch, err := newLANChannel(conn, false, opts.Confirm)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.WriteFrame(share); err != nil {
+		return err
+	}
+	b, err := ch.ReadFrame()
+	if err != nil {
+		return err
+	}
+	var configs []json.RawMessage
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return err
+	}
+	complete := false
+	for _, config := range configs {
+		if complete, err = s.AddPeerToHandshake(config); err != nil {
+			return err
+		}
+	}
+	if !complete {
+		return errors.New("initiator did not send all peer configs")
+	}
+	return nil
+}
+
+// announceLAN broadcasts the handshake TCP port on the local link until done is closed. The limited broadcast
+// address is never forwarded by routers, so announcements stay on the local network.
+func announceLAN(tcpPort, discoveryPort int, done chan struct{}) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: discoveryPort}
+	msg := []byte(fmt.Sprintf("%v %v", lanAnnouncePrefix, tcpPort))
+	ticker := time.NewTicker(lanAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		conn.WriteTo(msg, dst)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discoverLAN waits for a handshake announcement from the local network and returns the TCP address
+// of the initiator
+func discoverLAN(discoveryPort int, timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: discoveryPort})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 256)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", err
+		}
+		if !isLocalLink(from) {
+			continue
+		}
+		fields := strings.Fields(string(buf[:n]))
+		if len(fields) != 2 || fields[0] != lanAnnouncePrefix {
+			continue
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port < 1 || port > 65535 {
+			continue
+		}
+		return net.JoinHostPort(from.IP.String(), fields[1]), nil
+	}
+}
+
+// isLocalLink returns true if addr is a loopback address or belongs to a network directly attached to
+// one of the local interfaces
+func isLocalLink(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lanChannel is an encrypted, length-prefixed framing of a LAN connection. Keys are agreed with an
+// ephemeral X25519 exchange and authenticated by users comparing the short authentication string. The joiner
+// commits to its public key before it learns the host key, so an attacker in the middle can not search for
+// keys that give both sides the same string and has a single guess per connection.
+type lanChannel struct {
+	conn       net.Conn
+	cipher     SecretBoxCipher
+	sendKey    []byte
+	receiveKey []byte
+}
+
+// newLANChannel performs the key exchange over conn and asks confirm to verify the short authentication
+// string. host must be true on the initiator side and false on the joiner side.
+func newLANChannel(conn net.Conn, host bool, confirm func(string) bool) (*lanChannel, error) {
+	var private, public, remote, shared [32]byte
+	copy(private[:], genRandBytes(32))
+	defer wipeBytes(private[:])
+	curve25519.ScalarBaseMult(&public, &private)
+
+	if host {
+		var commitment [32]byte
+		if _, err := io.ReadFull(conn, commitment[:]); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(public[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, remote[:]); err != nil {
+			return nil, err
+		}
+		if expected := lanCommitment(remote[:]); subtle.ConstantTimeCompare(expected[:], commitment[:]) != 1 {
+			return nil, errors.New("joiner key does not match its commitment")
+		}
+	} else {
+		commitment := lanCommitment(public[:])
+		if _, err := conn.Write(commitment[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, remote[:]); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(public[:]); err != nil {
+			return nil, err
+		}
+	}
+	curve25519.ScalarMult(&shared, &private, &remote)
+	defer wipeBytes(shared[:])
+
+	hostPublic, joinerPublic := public[:], remote[:]
+	if !host {
+		hostPublic, joinerPublic = remote[:], public[:]
+	}
+	var transcript []byte
+	transcript = append(transcript, hostPublic...)
+	transcript = append(transcript, joinerPublic...)
+	transcript = append(transcript, shared[:]...)
+
+	hostKey := blake2b.Sum256(append([]byte("handshake-lan host"), transcript...))
+	joinerKey := blake2b.Sum256(append([]byte("handshake-lan joiner"), transcript...))
+	sasHash := blake2b.Sum256(append([]byte("handshake-lan sas"), transcript...))
+
+	if confirm == nil || !confirm(genSAS(sasHash[:])) {
+		return nil, errors.New("short authentication string was not confirmed")
+	}
+
+	ch := lanChannel{conn: conn, cipher: newDefaultSBCipher()}
+	if host {
+		ch.sendKey, ch.receiveKey = hostKey[:], joinerKey[:]
+	} else {
+		ch.sendKey, ch.receiveKey = joinerKey[:], hostKey[:]
+	}
+	return &ch, nil
+}
+
+// lanCommitment returns the hash the joiner sends before revealing its public key
+func lanCommitment(public []byte) [32]byte {
+	return blake2b.Sum256(append([]byte("handshake-lan commit"), public...))
+}
+
+// genSAS converts a hash into a short authentication string of NATO alphabet words. Bytes at or above the
+// largest multiple of the word count are skipped so every word is equally likely, and the hash is extended
+// with a counter if it runs out.
+func genSAS(hash []byte) string {
+	limit := 256 - 256%len(npa)
+	var words []string
+	stream := hash
+	for counter := byte(0); len(words) < lanSASWords; counter++ {
+		for _, b := range stream {
+			if int(b) >= limit {
+				continue
+			}
+			if words = append(words, npa[int(b)%len(npa)]); len(words) == lanSASWords {
+				break
+			}
+		}
+		next := blake2b.Sum256(append(append([]byte{}, hash...), counter))
+		stream = next[:]
+	}
+	return strings.Join(words, "-")
+}
+
+// WriteFrame encrypts b and writes it to the connection with a length prefix
+func (ch *lanChannel) WriteFrame(b []byte) error {
+	encrypted, err := ch.cipher.Encrypt(b, ch.sendKey)
+	if err != nil {
+		return err
+	}
+	if len(encrypted) > lanMaxFrameSize {
+		return errors.New("frame exceeds max size")
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(encrypted)))
+	if _, err := ch.conn.Write(append(header, encrypted...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame reads a length prefixed frame from the connection and decrypts it
+func (ch *lanChannel) ReadFrame() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(ch.conn, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > lanMaxFrameSize {
+		return nil, errors.New("frame exceeds max size")
+	}
+	encrypted := make([]byte, size)
+	if _, err := io.ReadFull(ch.conn, encrypted); err != nil {
+		return nil, err
+	}
+	return ch.cipher.Decrypt(encrypted, ch.receiveKey)
+}
+
+// Close closes the underlying connection
+func (ch *lanChannel) Close() error {
+	return ch.conn.Close()
+}
@@ -0,0 +1,287 @@
+package handshake
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLANHandshake(t *testing.T) {
+	hostPath := "lan-host-handshake.boltdb"
+	joinPath := "lan-join-handshake.boltdb"
+	defer os.Remove(hostPath)
+	defer os.Remove(joinPath)
+
+	host := newTestSession(t, hostPath, "host_password")
+	defer host.Close()
+	joiner := newTestSession(t, joinPath, "joiner_password")
+	defer joiner.Close()
+
+	if err := host.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if err := joiner.NewPeerWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	hostSAS := make(chan string, 1)
+	opts := LANOptions{
+		Peers:   1,
+		Timeout: 10 * time.Second,
+		Confirm: func(sas string) bool {
+			hostSAS <- sas
+			return true
+		},
+	}
+	hostErr := make(chan error, 1)
+	go func() { hostErr <- host.hostLAN(l, opts) }()
+
+	var joinerSAS string
+	joinOpts := LANOptions{
+		Timeout: 10 * time.Second,
+		Confirm: func(sas string) bool {
+			joinerSAS = sas
+			return true
+		},
+	}
+	if err := joiner.joinLAN(l.Addr().String(), joinOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+	if sas := <-hostSAS; sas != joinerSAS {
+		t.Errorf("short authentication strings do not match: %v != %v", sas, joinerSAS)
+	}
+	if _, err := host.NewChat(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joiner.NewChat(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLANHandshakeGroup(t *testing.T) {
+	paths := []string{"lan-host-group.boltdb", "lan-join-group-1.boltdb", "lan-join-group-2.boltdb"}
+	defer removeTestDBs(paths...)
+
+	host := newTestSession(t, paths[0], "host_password")
+	defer host.Close()
+	if err := host.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	var joiners []*Session
+	for i, path := range paths[1:] {
+		joiner := newTestSession(t, path, fmt.Sprintf("joiner_password_%v", i))
+		defer joiner.Close()
+		if err := joiner.NewPeerWithDefaults(); err != nil {
+			t.Fatal(err)
+		}
+		joiners = append(joiners, joiner)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	confirm := func(sas string) bool { return true }
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- host.hostLAN(l, LANOptions{Peers: len(joiners), Timeout: 10 * time.Second, Confirm: confirm})
+	}()
+	joinErrs := make(chan error, len(joiners))
+	for _, joiner := range joiners {
+		go func(joiner *Session) {
+			joinErrs <- joiner.joinLAN(l.Addr().String(), LANOptions{Timeout: 10 * time.Second, Confirm: confirm})
+		}(joiner)
+	}
+	for range joiners {
+		if err := <-joinErrs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if total := host.GetHandshakePeerTotal(); total != 3 {
+		t.Errorf("expected 3 parties in the handshake, got %v", total)
+	}
+	for _, s := range append([]*Session{host}, joiners...) {
+		chatID, err := s.NewChat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := s.getChat(chatID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Peers) != 3 {
+			t.Errorf("expected a chat with 3 members, got %v", len(c.Peers))
+		}
+	}
+}
+
+func TestLANHandshakeRejectedSAS(t *testing.T) {
+	paths := []string{"lan-host-rejected.boltdb", "lan-join-rejected.boltdb"}
+	defer removeTestDBs(paths...)
+
+	host := newTestSession(t, paths[0], "host_password")
+	defer host.Close()
+	joiner := newTestSession(t, paths[1], "joiner_password")
+	defer joiner.Close()
+	if err := host.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if err := joiner.NewPeerWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- host.hostLAN(l, LANOptions{
+			Peers:   1,
+			Timeout: 2 * time.Second,
+			Confirm: func(sas string) bool { return false },
+		})
+	}()
+	err = joiner.joinLAN(l.Addr().String(), LANOptions{
+		Timeout: 2 * time.Second,
+		Confirm: func(sas string) bool { return true },
+	})
+	if err == nil {
+		t.Error("expected the joiner to fail once the host rejects the short authentication string")
+	}
+	if err := <-hostErr; err == nil {
+		t.Error("expected the host to time out without any confirmed joiner")
+	}
+	if total := host.GetHandshakePeerTotal(); total != 1 {
+		t.Errorf("expected the rejected joiner not to be added, got %v parties", total)
+	}
+}
+
+func TestLANHandshakeRejectedPeer(t *testing.T) {
+	paths := []string{"lan-host-rejected-peer.boltdb", "lan-join-rejected-peer.boltdb"}
+	defer removeTestDBs(paths...)
+
+	host := newTestSession(t, paths[0], "host_password")
+	defer host.Close()
+	joiner := newTestSession(t, paths[1], "joiner_password")
+	defer joiner.Close()
+	if err := host.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if err := joiner.NewPeerWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	confirm := func(sas string) bool { return true }
+	rejected := make(chan error, 1)
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- host.hostLAN(l, LANOptions{
+			Peers:    1,
+			Timeout:  10 * time.Second,
+			Confirm:  confirm,
+			Rejected: func(err error) { rejected <- err },
+		})
+	}()
+
+	// a device on the link that sends an invalid config must not abort the handshake for everyone else
+	conn, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := newLANChannel(conn, false, confirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.WriteFrame([]byte("not a peer config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rejected; !errors.Is(err, ErrPeerRejected) {
+		t.Errorf("expected ErrPeerRejected, got %v", err)
+	}
+	ch.Close()
+
+	if err := joiner.joinLAN(l.Addr().String(), LANOptions{Timeout: 10 * time.Second, Confirm: confirm}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLANCommitmentMismatch(t *testing.T) {
+	hostConn, joinerConn := net.Pipe()
+	defer joinerConn.Close()
+	hostErr := make(chan error, 1)
+	go func() {
+		_, err := newLANChannel(hostConn, true, func(sas string) bool { return true })
+		hostConn.Close()
+		hostErr <- err
+	}()
+
+	// commit to one key and reveal another, as an attacker searching for matching strings would
+	commitment := lanCommitment(genRandBytes(32))
+	if _, err := joinerConn.Write(commitment[:]); err != nil {
+		t.Fatal(err)
+	}
+	hostPublic := make([]byte, 32)
+	if _, err := io.ReadFull(joinerConn, hostPublic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinerConn.Write(genRandBytes(32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-hostErr; err == nil {
+		t.Error("expected the host to reject a key that does not match the commitment")
+	}
+}
+
+func TestGenSAS(t *testing.T) {
+	hash := genRandBytes(32)
+	sas := genSAS(hash)
+	if n := sasWords(sas); n != lanSASWords {
+		t.Errorf("expected %v words, got %v", lanSASWords, sas)
+	}
+	if genSAS(hash) != sas {
+		t.Error("expected the same hash to give the same string")
+	}
+	// every byte is rejected, so the words come from the extended hash
+	high := bytes.Repeat([]byte{0xff}, 32)
+	if sas := genSAS(high); sasWords(sas) != lanSASWords {
+		t.Errorf("expected %v words for a hash of rejected bytes, got %v", lanSASWords, sas)
+	}
+}
+
+// sasWords counts the words of a short authentication string, x-ray being the one word with a dash
+func sasWords(sas string) int {
+	return len(strings.Split(sas, "-")) - strings.Count(sas, "x-ray")
+}
@@ -0,0 +1,544 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// controlAddMember is the chatControl type used to add a newcomer to a chat
+	controlAddMember = "add_member"
+	// controlLeave is the chatControl type sent by a peer that leaves a chat
+	controlLeave = "leave"
+	// controlRemoveMember is the chatControl type used to eject the peer in Member from a chat
+	controlRemoveMember = "remove_member"
+	pepperLength        = 64
+)
+
+// chatControl is an encrypted membership change sent through the chat like any other message
+type chatControl struct {
+	Type       string       `json:"type"`
+	Member     *chatMember  `json:"member,omitempty"`
+	Keys       *epochKeys   `json:"keys,omitempty"`
+	Rendezvous *peerStorage `json:"rendezvous,omitempty"`
+}
+
+// chatMember is the shareable description of a chat peer
+type chatMember struct {
+	Fingerprint string             `json:"fingerprint"`
+	Alias       string             `json:"alias"`
+	Config      strategyPeerConfig `json:"config"`
+}
+
+// epochKeys holds the fresh entropy, keyed by peer fingerprint, used to generate new lookups when
+// the membership of a chat changes
+type epochKeys struct {
+	Pepper  []byte            `json:"pepper"`
+	Entropy map[string][]byte `json:"entropy"`
+}
+
+// chatInvite is shared in person with a newcomer and holds everything needed to join an existing chat.
+// It only contains keys generated for the new epoch, so earlier history can not be decrypted.
+type chatInvite struct {
+	Version     string       `json:"version"`
+	Fingerprint string       `json:"fingerprint"`
+	Members     []chatMember `json:"members"`
+	Keys        epochKeys    `json:"keys"`
+	MaxTTL      int64        `json:"max_ttl,omitempty"`
+	Cipher      CipherType   `json:"cipher"`
+	KDF         kdfParams    `json:"kdf"`
+}
+
+// Invite is created by AddMember for a newcomer and passed to Join. It holds keys of the chat, so it must only
+// be given to the newcomer in person.
+type Invite struct {
+	invite chatInvite
+}
+
+// MarshalJSON encodes the Invite in the format returned by InviteToChat
+func (i Invite) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.invite)
+}
+
+// UnmarshalJSON decodes an Invite encoded by MarshalJSON or InviteToChat
+func (i *Invite) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &i.invite)
+}
+
+// peerFingerprint derives an identifier for a chat peer that is the same on every member's device
+func peerFingerprint(pepper, entropy []byte) string {
+	var b []byte
+	b = append(b, pepper...)
+	b = append(b, entropy...)
+	h := blake2b.Sum256(b)
+	return hex.EncodeToString(h[:16])
+}
+
+// InviteToChat takes a chatID and the json encoded PeerConfig of a newcomer, as returned by
+// ShareHandshakePosition, and adds the newcomer to the chat with AddMember. It returns the json encoded Invite.
+func (s *Session) InviteToChat(chatID string, body []byte) ([]byte, error) {
+	var config PeerConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return []byte{}, err
+	}
+	invite, err := s.AddMember(chatID, config)
+	if err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(invite)
+}
+
+// AddMember takes a chatID and the PeerConfig of a newcomer and adds the newcomer to the chat. New keys are
+// generated for every member and sent to the existing members in an encrypted membership change. The returned
+// Invite must be given to the newcomer in person and passed to Join.
+func (s *Session) AddMember(chatID string, newcomerConfig PeerConfig) (Invite, error) {
+	defer s.lockChat(chatID)()
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return Invite{}, err
+	}
+	if c.Left {
+		return Invite{}, ErrChatReadOnly
+	}
+	config := newcomerConfig.config
+	if err := checkVersion(config.Version); err != nil {
+		return Invite{}, err
+	}
+	if err := localCapabilities().supports(config.Config); err != nil {
+		return Invite{}, fmt.Errorf("incompatible peer strategy: %w", err)
+	}
+	newcomer, err := newNegotiatorFromPeerConfig(config)
+	if err != nil {
+		return Invite{}, err
+	}
+	if len(newcomer.Entropy) != defaultEntropyBytes {
+		return Invite{}, errors.New("invalid newcomer entropy")
+	}
+
+	// the sponsor moves to a new rendezvous, so members that have not processed the membership change
+	// still find it at the old one
+	self := c.Peers[c.PeerID]
+	selfStrategy, err := self.Strategy.withNewRendezvous()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	keys := epochKeys{
+		Pepper:  genRandBytes(pepperLength),
+		Entropy: make(map[string][]byte),
+	}
+	invite := chatInvite{
+		Version: Version,
+		MaxTTL:  c.Settings.MaxTTL,
+		Cipher:  c.Settings.Cipher,
+		KDF:     c.kdf(),
+	}
+	for id, p := range c.Peers {
+		if !p.Active() {
+			continue
+		}
+		if p.Fingerprint == "" {
+			return Invite{}, errors.New("chat does not support membership changes")
+		}
+		strategy := p.Strategy
+		if id == c.PeerID {
+			strategy = selfStrategy
+		}
+		shared, err := strategy.Share()
+		if err != nil {
+			return Invite{}, err
+		}
+		if err := config.Capabilities.supports(shared); err != nil {
+			return Invite{}, fmt.Errorf("newcomer can not use the strategy of %v: %w", p.Alias, err)
+		}
+		invite.Members = append(invite.Members, chatMember{
+			Fingerprint: p.Fingerprint,
+			Alias:       p.Alias,
+			Config:      shared,
+		})
+		keys.Entropy[p.Fingerprint] = genRandBytes(defaultEntropyBytes)
+	}
+	invite.Fingerprint = peerFingerprint(keys.Pepper, newcomer.Entropy)
+	keys.Entropy[invite.Fingerprint] = newcomer.Entropy
+	// the keys of the membership change are wiped once it is applied, the invite keeps its own copy
+	invite.Keys = keys.clone()
+
+	rendezvous, err := selfStrategy.Rendezvous.share()
+	if err != nil {
+		return Invite{}, err
+	}
+	control := chatControl{
+		Type: controlAddMember,
+		Member: &chatMember{
+			Fingerprint: invite.Fingerprint,
+			Alias:       newcomer.Alias,
+			Config:      config.Config,
+		},
+		Keys:       &keys,
+		Rendezvous: &rendezvous,
+	}
+	// the membership change is encrypted with the current keys, which the newcomer never receives
+	if _, err := s.sendChatData(chatID, control); err != nil {
+		return Invite{}, err
+	}
+
+	if c, err = s.getChat(chatID); err != nil {
+		return Invite{}, err
+	}
+	self.Strategy = selfStrategy
+	c.Peers[c.PeerID] = self
+	if err := s.applyAddMember(&c, c.PeerID, time.Now().UnixNano(), control); err != nil {
+		return Invite{}, err
+	}
+	if err := s.updateFetchIndex(); err != nil {
+		return Invite{}, err
+	}
+	return Invite{invite: invite}, nil
+}
+
+// JoinChat takes a json encoded Invite, as returned by InviteToChat, and joins the chat with Join.
+// It returns a chat ID string and error.
+func (s *Session) JoinChat(body []byte) (string, error) {
+	var invite Invite
+	if err := json.Unmarshal(body, &invite); err != nil {
+		return "", err
+	}
+	return s.Join(invite)
+}
+
+// Join takes an Invite created by AddMember for the ActiveHandshake and creates the chat. The keys of the
+// Invite are wiped once they are used. It returns a chat ID string and error.
+func (s *Session) Join(i Invite) (string, error) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	h, err := s.getActiveHandshake()
+	if err != nil {
+		return "", err
+	}
+	if h.Role != peer {
+		return "", errors.New("only a peer can join a chat")
+	}
+	invite := i.invite
+	if err := checkVersion(invite.Version); err != nil {
+		return "", err
+	}
+	entropy := invite.Keys.Entropy[invite.Fingerprint]
+	if !bytes.Equal(entropy, h.Position.Entropy) || peerFingerprint(invite.Keys.Pepper, entropy) != invite.Fingerprint {
+		return "", errors.New("invite was not created for this handshake")
+	}
+
+	chatID := hex.EncodeToString(genRandBytes(chatIDLength))
+	// readers that list the chat while it is written wait until it is complete
+	defer s.lockChat(chatID)()
+	c := chat{
+		ID:    chatID,
+		Peers: make(map[string]chatPeer),
+		Settings: chatSettings{
+			MaxTTL: invite.MaxTTL,
+			Cipher: invite.Cipher,
+			KDF:    invite.KDF,
+		},
+	}
+	self := chatPeer{
+		ID:          hex.EncodeToString(genRandBytes(chatIDLength)),
+		Alias:       h.Position.Alias,
+		Strategy:    h.Position.Strategy,
+		Fingerprint: invite.Fingerprint,
+	}
+	c.PeerID = self.ID
+	c.Peers[self.ID] = self
+	for _, m := range invite.Members {
+		strategy, err := strategyFromPeerConfig(m.Config)
+		if err != nil {
+			return "", err
+		}
+		p := chatPeer{
+			ID:          hex.EncodeToString(genRandBytes(chatIDLength)),
+			Alias:       m.Alias,
+			Strategy:    strategy,
+			Fingerprint: m.Fingerprint,
+		}
+		c.Peers[p.ID] = p
+	}
+
+	basePath := fmt.Sprintf("chats/%v/%v", chatID, s.profileID())
+	for _, p := range c.Peers {
+		lookups, err := epochLookups(c, invite.Keys, p.Fingerprint)
+		if err != nil {
+			deleteAllWithPrefix(s.storage, basePath)
+			return "", err
+		}
+		if err := s.setLookup(chatID, p.ID, lookups); err != nil {
+			deleteAllWithPrefix(s.storage, basePath)
+			return "", err
+		}
+	}
+	if err := s.setChat(chatID, c); err != nil {
+		deleteAllWithPrefix(s.storage, basePath)
+		return "", err
+	}
+	if err := s.setChatlog(chatID, make(chatLog)); err != nil {
+		deleteAllWithPrefix(s.storage, basePath)
+		return "", err
+	}
+	wipeEpochKeys(invite.Keys)
+	if err := s.abandonHandshake(); err != nil {
+		return "", err
+	}
+	if err := s.updateFetchIndex(); err != nil {
+		return "", err
+	}
+	return chatID, nil
+}
+
+// LeaveChat takes a chatID and tells the other members that the profile user left the chat. The chat
+// becomes read-only and the lookups are securely deleted, so no new messages can be sent or received.
+func (s *Session) LeaveChat(chatID string) error {
+	defer s.lockChat(chatID)()
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	if c.Left {
+		return nil
+	}
+	if c.ActivePeerCount() > 1 {
+		if _, err := s.sendChatData(chatID, chatControl{Type: controlLeave}); err != nil {
+			return err
+		}
+		if c, err = s.getChat(chatID); err != nil {
+			return err
+		}
+	}
+	self := c.Peers[c.PeerID]
+	c.Left = true
+	c.addEvent(controlLeave, self, time.Now().UnixNano())
+	if err := s.setChatWithEvent(c); err != nil {
+		return err
+	}
+	if err := s.purgeInactiveLookups(c); err != nil {
+		return err
+	}
+	return s.updateFetchIndex()
+}
+
+// RemoveMember takes a chatID and the peerID of another member and ejects the member from the chat.
+// The other members stop polling the rendezvous point of the removed peer and the chat becomes read-only
+// for the removed peer. The removed peer still holds the keys of the remaining members, so this does not
+// prevent it from reading messages sent to the old rendezvous points, a new chat should be created if that
+// is a concern.
+func (s *Session) RemoveMember(chatID, peerID string) error {
+	defer s.lockChat(chatID)()
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	if c.Left {
+		return ErrChatReadOnly
+	}
+	if peerID == c.PeerID {
+		return errors.New("use LeaveChat to leave a chat")
+	}
+	p, ok := c.Peers[peerID]
+	if !ok {
+		return errors.New("peer not found in chat")
+	}
+	if !p.Active() {
+		return nil
+	}
+	if p.Fingerprint == "" {
+		return errors.New("chat does not support membership changes")
+	}
+	control := chatControl{
+		Type: controlRemoveMember,
+		Member: &chatMember{
+			Fingerprint: p.Fingerprint,
+			Alias:       p.Alias,
+		},
+	}
+	if _, err := s.sendChatData(chatID, control); err != nil {
+		return err
+	}
+	if c, err = s.getChat(chatID); err != nil {
+		return err
+	}
+	if err := s.applyRemoveMember(&c, c.PeerID, time.Now().UnixNano(), control); err != nil {
+		return err
+	}
+	if err := s.purgeInactiveLookups(c); err != nil {
+		return err
+	}
+	return s.updateFetchIndex()
+}
+
+// applyControl processes a membership change received from peerID
+func (s *Session) applyControl(chatID, peerID string, timestamp int64, control chatControl) error {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	switch control.Type {
+	case controlAddMember:
+		return s.applyAddMember(&c, peerID, timestamp, control)
+	case controlLeave:
+		return s.applyLeave(&c, peerID, timestamp)
+	case controlRemoveMember:
+		return s.applyRemoveMember(&c, peerID, timestamp, control)
+	default:
+		return fmt.Errorf("unknown control message type: %v", control.Type)
+	}
+}
+
+// applyAddMember adds the newcomer in control to the chat and moves every member to the lookups of the
+// new epoch. Lookups of other members keep their unused keys so that messages sent before they processed
+// the change can still be read, while the profile user's own lookup is replaced.
+func (s *Session) applyAddMember(c *chat, senderID string, timestamp int64, control chatControl) error {
+	if control.Member == nil || control.Keys == nil {
+		return errors.New("invalid add member control message")
+	}
+	defer wipeEpochKeys(*control.Keys)
+	if _, exists := c.peerByFingerprint(control.Member.Fingerprint); exists {
+		return nil
+	}
+	strategy, err := strategyFromPeerConfig(control.Member.Config)
+	if err != nil {
+		return err
+	}
+	newcomer := chatPeer{
+		ID:          hex.EncodeToString(genRandBytes(chatIDLength)),
+		Alias:       control.Member.Alias,
+		Strategy:    strategy,
+		Fingerprint: control.Member.Fingerprint,
+	}
+	c.Peers[newcomer.ID] = newcomer
+
+	for _, p := range c.Peers {
+		if !p.Active() {
+			continue
+		}
+		lookups, err := epochLookups(*c, *control.Keys, p.Fingerprint)
+		if err != nil {
+			return err
+		}
+		if p.ID != c.PeerID && p.ID != newcomer.ID {
+			previous, err := s.getLookup(c.ID, p.ID)
+			if err != nil {
+				return err
+			}
+			for k, v := range previous {
+				lookups[k] = v
+			}
+		}
+		if err := s.setLookup(c.ID, p.ID, lookups); err != nil {
+			return err
+		}
+	}
+
+	if senderID != c.PeerID && control.Rendezvous != nil {
+		sender, ok := c.Peers[senderID]
+		if !ok {
+			return errors.New("membership change from unknown peer")
+		}
+		if sender.Strategy.Rendezvous, err = newStorageFromPeer(*control.Rendezvous); err != nil {
+			return err
+		}
+		c.Peers[senderID] = sender
+	}
+	c.Epoch++
+	c.addEvent(controlAddMember, newcomer, timestamp)
+	return s.setChatWithEvent(*c)
+}
+
+// applyLeave tombstones senderID, the peer that left the chat
+func (s *Session) applyLeave(c *chat, senderID string, timestamp int64) error {
+	p, ok := c.Peers[senderID]
+	if !ok {
+		return errors.New("membership change from unknown peer")
+	}
+	if !p.Active() {
+		return nil
+	}
+	p.Tombstone = timestamp
+	c.Peers[senderID] = p
+	c.addEvent(controlLeave, p, timestamp)
+	return s.setChatWithEvent(*c)
+}
+
+// applyRemoveMember tombstones the peer in control. If the profile user is the one removed, the chat is
+// marked as left instead.
+func (s *Session) applyRemoveMember(c *chat, senderID string, timestamp int64, control chatControl) error {
+	if control.Member == nil {
+		return errors.New("invalid remove member control message")
+	}
+	if _, ok := c.Peers[senderID]; !ok {
+		return errors.New("membership change from unknown peer")
+	}
+	p, ok := c.peerByFingerprint(control.Member.Fingerprint)
+	if !ok || !p.Active() {
+		return nil
+	}
+	if p.ID == c.PeerID {
+		c.Left = true
+	} else {
+		p.Tombstone = timestamp
+		c.Peers[p.ID] = p
+	}
+	c.addEvent(controlRemoveMember, p, timestamp)
+	return s.setChatWithEvent(*c)
+}
+
+// purgeInactiveLookups securely deletes the lookups that are no longer needed, those of tombstoned peers
+// or all of them if the profile user left the chat
+func (s *Session) purgeInactiveLookups(c chat) error {
+	for _, p := range c.Peers {
+		if p.Active() && !c.Left {
+			continue
+		}
+		key := fmt.Sprintf("chats/%v/%v/lookups/%v", c.ID, s.profileID(), p.ID)
+		if err := secureDelete(s.storage, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// epochLookups generates the lookups of the peer with fingerprint from the entropy in keys
+func epochLookups(c chat, keys epochKeys, fingerprint string) (lookup, error) {
+	entropy, ok := keys.Entropy[fingerprint]
+	if !ok || len(entropy) != defaultEntropyBytes || len(keys.Pepper) != pepperLength {
+		return lookup{}, fmt.Errorf("missing keys for peer %v", fingerprint)
+	}
+	var p [64]byte
+	var e [96]byte
+	copy(p[:], keys.Pepper)
+	copy(e[:], entropy)
+	defer wipeBytes(p[:])
+	defer wipeBytes(e[:])
+	return genLookupsWithKDF(p, e, c.Settings.Cipher, defaultLookupCount, c.kdf())
+}
+
+// clone returns a copy of keys that does not share memory with it
+func (k epochKeys) clone() epochKeys {
+	c := epochKeys{
+		Pepper:  append([]byte{}, k.Pepper...),
+		Entropy: make(map[string][]byte),
+	}
+	for fingerprint, e := range k.Entropy {
+		c.Entropy[fingerprint] = append([]byte{}, e...)
+	}
+	return c
+}
+
+// wipeEpochKeys overwrites all entropy held in keys
+func wipeEpochKeys(keys epochKeys) {
+	wipeBytes(keys.Pepper)
+	for _, e := range keys.Entropy {
+		wipeBytes(e)
+	}
+}
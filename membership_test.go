@@ -0,0 +1,248 @@
+package handshake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInviteToChat(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-invite.boltdb", "bob-invite.boltdb", "carol-invite.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	carol := newTestSession(t, paths[2], "carol_password")
+	defer carol.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "before carol"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carol.NewPeer(n.strategy()); err != nil {
+		t.Fatal(err)
+	}
+	config, err := carol.HandshakePosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := alice.AddMember(aliceChatID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolChatID, err := carol.Join(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := messages[len(messages)-1].Data.Control
+	if control == nil || control.Type != controlAddMember || control.Alias != config.Alias() {
+		t.Errorf("expected the membership change to name %v, got %+v", config.Alias(), control)
+	}
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "welcome carol"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "hi carol"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	carolLog, err := carol.RetrieveMessages(carolChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"welcome carol", "hi carol"}
+	if got := messagesIn(t, carolLog); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected carol to only see %v, got %v", expected, got)
+	}
+
+	if _, err := carol.SendMessage(carolChatID, []byte(`{"message": "thanks"}`)); err != nil {
+		t.Fatal(err)
+	}
+	bobLog, err := bob.RetrieveMessages(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"before carol", "welcome carol", "hi carol", "thanks"}
+	if got := messagesIn(t, bobLog); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected bob to see %v, got %v", expected, got)
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-remove.boltdb", "bob-remove.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.RetrieveMessages(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	aliceChat, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bobID string
+	for id := range aliceChat.Peers {
+		if id != aliceChat.PeerID {
+			bobID = id
+		}
+	}
+	if err := alice.RemoveMember(aliceChatID, bobID); err != nil {
+		t.Fatal(err)
+	}
+	if aliceChat, err = alice.getChat(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	if aliceChat.Peers[bobID].Active() || !aliceChat.ReadOnly() {
+		t.Error("expected bob to be tombstoned and the chat to be read-only")
+	}
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "anyone?"}`)); err == nil {
+		t.Error("expected sending to a read-only chat to fail")
+	}
+
+	if _, err := bob.RetrieveMessages(bobChatID); err != nil {
+		t.Fatal(err)
+	}
+	bobChat, err := bob.getChat(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bobChat.Left || len(bobChat.Events) != 1 || bobChat.Events[0].Type != controlRemoveMember {
+		t.Errorf("expected bob to see his removal, got %+v", bobChat.Events)
+	}
+	keys, err := bob.storage.List(fmt.Sprintf("chats/%v/%v/lookups/", bobChatID, bob.profile.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected lookups to be deleted, found %v", len(keys))
+	}
+
+	var summaries []ChatInfo
+	list, err := bob.ListChats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(list, &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || !summaries[0].ReadOnly || len(summaries[0].Events) != 1 {
+		t.Errorf("unexpected chat list %v", string(list))
+	}
+}
+
+func TestLeaveChat(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-leave.boltdb", "bob-leave.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "goodbye"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.LeaveChat(bobChatID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "still here?"}`)); err == nil {
+		t.Error("expected sending after leaving to fail")
+	}
+
+	aliceLog, err := alice.RetrieveMessages(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messagesIn(t, aliceLog); !reflect.DeepEqual(got, []string{"goodbye"}) {
+		t.Errorf("expected the message sent before leaving, got %v", got)
+	}
+	aliceChat, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aliceChat.ReadOnly() || len(aliceChat.Events) != 1 || aliceChat.Events[0].Type != controlLeave {
+		t.Errorf("expected alice to see bob leave, got %+v", aliceChat.Events)
+	}
+}
+
+func TestFailedInviteIsNotResumed(t *testing.T) {
+	defer func(delay time.Duration) { sendRetryDelay = delay }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-failed-invite.boltdb", "bob-failed-invite.boltdb", "carol-failed-invite.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	carol := newTestSession(t, paths[2], "carol_password")
+	defer carol.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if err := carol.NewPeer(n.strategy()); err != nil {
+		t.Fatal(err)
+	}
+	share, err := carol.ShareHandshakePosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.setOffline(true)
+	if _, err := alice.InviteToChat(aliceChatID, share); !errors.Is(err, ErrNodesUnavailable) {
+		t.Fatalf("expected the invite to fail while offline, got %v", err)
+	}
+	if _, ok, err := alice.getPendingSend(aliceChatID); ok || err != nil {
+		t.Errorf("expected the membership change not to be kept for a later send, got %v, %v", ok, err)
+	}
+
+	n.setOffline(false)
+	if _, err := alice.Send(aliceChatID, MessageData{Message: "after the failed invite"}); err != nil {
+		t.Fatal(err)
+	}
+	received, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Data.Control != nil || received[0].Data.Message != "after the failed invite" {
+		t.Errorf("expected bob to only receive the message, got %+v", received)
+	}
+	aliceChat, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobChat, err := bob.getChat(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceChat.Epoch != bobChat.Epoch || len(aliceChat.Peers) != 2 || len(bobChat.Peers) != 2 {
+		t.Errorf("expected both members to keep the same membership, got epochs %v and %v", aliceChat.Epoch, bobChat.Epoch)
+	}
+}
@@ -0,0 +1,196 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// queuedMessage is a message in the outbox of a chat, waiting to be sent
+type queuedMessage struct {
+	ID     string // a local ID, used for the pending Message until the storage hash is known
+	Queued int64
+	Data   MessageData
+}
+
+// pendingError wraps the error that kept a message in the outbox, so it matches both ErrMessagePending and the
+// underlying error with errors.Is
+type pendingError struct {
+	err error
+}
+
+func (e pendingError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrMessagePending, e.err)
+}
+
+func (e pendingError) Is(target error) bool {
+	return target == ErrMessagePending
+}
+
+func (e pendingError) Unwrap() error {
+	return e.err
+}
+
+// FlushOutbox takes a chatID and sends the messages in its outbox in the order they were queued. It returns the
+// sorted chat log, which still shows the messages that could not be sent as pending, and an error. If the chat
+// became read-only, the messages are dropped and ErrChatReadOnly is returned.
+func (s *Session) FlushOutbox(chatID string) ([]Message, error) {
+	defer s.lockChat(chatID)()
+	if err := s.flushOutbox(chatID); err != nil {
+		return nil, err
+	}
+	return s.Messages(chatID)
+}
+
+// flushOutbox completes the pending send of chatID and then sends every queued message, stopping at the first
+// error. Each message is removed from the outbox when its send is committed. The messages of a read-only chat
+// are dropped.
+func (s *Session) flushOutbox(chatID string) error {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	if c.ReadOnly() {
+		return s.dropOutbox(chatID)
+	}
+	if err := s.resumeSend(chatID); err != nil {
+		return err
+	}
+	for {
+		outbox, err := s.getOutbox(chatID)
+		if err != nil || len(outbox) == 0 {
+			return err
+		}
+		p, err := s.stageSend(chatID, payload{MessageData: outbox[0].Data}, outbox[0].ID)
+		if err != nil {
+			return err
+		}
+		if err := s.completeSend(chatID, p); err != nil {
+			return err
+		}
+	}
+}
+
+// dropOutbox securely deletes the pending send and the queued messages of chatID, which can not be sent once
+// the chat is read-only. It returns ErrChatReadOnly if any were dropped.
+func (s *Session) dropOutbox(chatID string) error {
+	p, pending, err := s.getPendingSend(chatID)
+	if err != nil {
+		return err
+	}
+	outbox, err := s.getOutbox(chatID)
+	if err != nil {
+		return err
+	}
+	if !pending && len(outbox) == 0 {
+		return nil
+	}
+	// a pending send is the first message of the outbox
+	wipeBytes(p.RendezvousValue)
+	if err := secureDelete(s.storage, s.pendingSendKey(chatID)); err != nil {
+		return err
+	}
+	if err := secureDelete(s.storage, s.outboxKey(chatID)); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v unsent messages were dropped", ErrChatReadOnly, len(outbox))
+}
+
+// queueMessage adds data to the end of the outbox of chatID. It returns ErrLookupExhausted if there are not
+// enough keys left to send every queued message.
+func (s *Session) queueMessage(chatID string, data MessageData) error {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	outbox, err := s.getOutbox(chatID)
+	if err != nil {
+		return err
+	}
+	l, err := s.getLookup(chatID, c.PeerID)
+	if err != nil {
+		return err
+	}
+	// a message and a rendezvous key are used for each send
+	if len(l) < 2*(len(outbox)+1) {
+		return ErrLookupExhausted
+	}
+	outbox = append(outbox, queuedMessage{
+		ID:     hex.EncodeToString(genRandBytes(chatIDLength)),
+		Queued: time.Now().UnixNano(),
+		Data:   data,
+	})
+	return s.setOutbox(chatID, outbox)
+}
+
+// removeFromOutbox removes the message with id from the outbox of chatID, if it is still there
+func (s *Session) removeFromOutbox(chatID, id string) error {
+	outbox, err := s.getOutbox(chatID)
+	if err != nil {
+		return err
+	}
+	for i, q := range outbox {
+		if q.ID == id {
+			return s.setOutbox(chatID, append(outbox[:i], outbox[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// pendingMessages returns the messages in the outbox of chatID as pending Messages, in the order they were queued
+func (s *Session) pendingMessages(chatID string) ([]Message, error) {
+	outbox, err := s.getOutbox(chatID)
+	if err != nil || len(outbox) == 0 {
+		return nil, err
+	}
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, q := range outbox {
+		messages = append(messages, Message{
+			ID:      q.ID,
+			Sender:  c.PeerID,
+			Sent:    q.Queued,
+			Data:    q.Data,
+			Pending: true,
+		})
+	}
+	return messages, nil
+}
+
+func (s *Session) outboxKey(chatID string) string {
+	return fmt.Sprintf("chats/%v/%v/outbox", chatID, s.profileID())
+}
+
+// getOutbox returns the queued messages of chatID, the outbox is empty if it was never written
+func (s *Session) getOutbox(chatID string) ([]queuedMessage, error) {
+	encrypted, err := s.storage.Get(s.outboxKey(chatID))
+	if err != nil || len(encrypted) == 0 {
+		return nil, err
+	}
+	outboxGob, err := s.decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var outbox []queuedMessage
+	if err := gob.NewDecoder(bytes.NewBuffer(outboxGob)).Decode(&outbox); err != nil {
+		return nil, err
+	}
+	return outbox, nil
+}
+
+func (s *Session) setOutbox(chatID string, outbox []queuedMessage) error {
+	if len(outbox) == 0 {
+		return s.storage.Delete(s.outboxKey(chatID))
+	}
+	outboxGob, err := encodeGob(outbox)
+	if err != nil {
+		return err
+	}
+	_, err = s.set(s.outboxKey(chatID), outboxGob)
+	return err
+}
@@ -0,0 +1,162 @@
+package handshake
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFlushOutbox(t *testing.T) {
+	defer func(delay time.Duration) { sendRetryDelay = delay }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-outbox.boltdb", "bob-outbox.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := alice.Send(aliceChatID, MessageData{Message: "sent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n.setOffline(true)
+	for i := 0; i < 3; i++ {
+		_, err := alice.Send(aliceChatID, MessageData{Message: fmt.Sprintf("queued %v", i)})
+		if !errors.Is(err, ErrMessagePending) || !errors.Is(err, ErrNodesUnavailable) {
+			t.Fatalf("expected the message to be pending while offline, got %v", err)
+		}
+	}
+	messages, err := alice.Messages(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 4 || messages[0].Pending {
+		t.Fatalf("expected one sent and three pending messages, got %+v", messages)
+	}
+	for i, m := range messages[1:] {
+		if !m.Pending || m.Data.Message != fmt.Sprintf("queued %v", i) {
+			t.Errorf("expected pending message %v in order, got %+v", i, m)
+		}
+	}
+	if _, err := alice.FlushOutbox(aliceChatID); !errors.Is(err, ErrNodesUnavailable) {
+		t.Errorf("expected flushing to fail while offline, got %v", err)
+	}
+
+	n.setOffline(false)
+	if messages, err = alice.FlushOutbox(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("expected four messages, got %+v", messages)
+	}
+	for _, m := range messages {
+		if m.Pending {
+			t.Errorf("expected every message to be sent, %+v is pending", m)
+		}
+	}
+
+	received, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 4 {
+		t.Fatalf("expected bob to receive four messages, got %+v", received)
+	}
+	for i, m := range received[1:] {
+		if m.Data.Message != fmt.Sprintf("queued %v", i) {
+			t.Errorf("expected queued message %v in order, got %+v", i, m)
+		}
+		if m.Data.Parent != received[i].ID {
+			t.Errorf("expected the parent of %q to be %v, got %v", m.Data.Message, received[i].ID, m.Data.Parent)
+		}
+	}
+}
+
+func TestQueueMessageLookupExhausted(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-queue.boltdb", "bob-queue.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, _ := newTestChat(t, n, alice, bob)
+	c, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.updateLookup(aliceChatID, c.PeerID, func(l lookup) error {
+		for len(l) > 3 {
+			l.popRandom()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.queueMessage(aliceChatID, MessageData{Message: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.queueMessage(aliceChatID, MessageData{Message: "second"}); !errors.Is(err, ErrLookupExhausted) {
+		t.Errorf("expected %v once queued messages need every key, got %v", ErrLookupExhausted, err)
+	}
+	if pending, err := alice.pendingMessages(aliceChatID); err != nil || len(pending) != 1 {
+		t.Errorf("expected one queued message, got %+v, %v", pending, err)
+	}
+}
+
+func TestFlushOutboxReadOnly(t *testing.T) {
+	defer func(delay time.Duration) { sendRetryDelay = delay }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-outbox-ro.boltdb", "bob-outbox-ro.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	n.setOffline(true)
+	for i := 0; i < 2; i++ {
+		if _, err := alice.Send(aliceChatID, MessageData{Message: fmt.Sprintf("queued %v", i)}); !errors.Is(err, ErrMessagePending) {
+			t.Fatalf("expected the message to be pending while offline, got %v", err)
+		}
+	}
+	n.setOffline(false)
+	if err := bob.LeaveChat(bobChatID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Retrieve(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := alice.FlushOutbox(aliceChatID); !errors.Is(err, ErrChatReadOnly) {
+		t.Fatalf("expected %v once the chat is read-only, got %v", ErrChatReadOnly, err)
+	}
+	if _, ok, err := alice.getPendingSend(aliceChatID); ok || err != nil {
+		t.Errorf("expected the pending send to be dropped, got %v, %v", ok, err)
+	}
+	messages, err := alice.FlushOutbox(aliceChatID)
+	if err != nil {
+		t.Fatalf("expected nothing left to flush, got %v", err)
+	}
+	for _, m := range messages {
+		if m.Pending {
+			t.Errorf("expected the queued messages to be dropped, %+v is pending", m)
+		}
+	}
+}
@@ -17,8 +17,15 @@ const (
 	profileKeyLength = 32
 	// profileKeyPrefix is the prefix used for the profile keys
 	profileKeyPrefix = "profiles/"
+	// DuressWipe securely deletes every profile and chat when the duress password is used
+	DuressWipe DuressAction = "wipe"
+	// DuressDecoy opens a decoy profile when the duress password is used
+	DuressDecoy DuressAction = "decoy"
 )
 
+// DuressAction is the action taken when a profile is opened with a duress password
+type DuressAction string
+
 // Profile represents a profile that has been accessed
 // this would contain successfully decrypted profile data
 type Profile struct {
@@ -30,6 +37,7 @@ type Profile struct {
 // ProfileSettings holds profile settings info
 type profileSettings struct {
 	SessionTTL int64
+	Duress     DuressAction
 }
 
 // takes gob encoded byte slice and returns a lookup and error
@@ -44,10 +52,18 @@ func newProfileFromGob(b []byte) (Profile, error) {
 // ProfilesExist configures a storage engine and checks `profilesExist`. It returns a bool and error.
 // This is used on app startup to check to see if this is the first time running the tool. If this function
 // returns `false` and no errors, the next step would be to prompt the user to setup a new profile using
-// `NewGenesisProfile()`.
+// `NewGenesisProfile()`. It uses the default storage in DefaultDataDir.
 func ProfilesExist() (bool, error) {
-	opts := StorageOptions{Engine: defaultStorageEngine}
-	storage, err := newStorage(opts)
+	opts, err := defaultSessionOptions()
+	if err != nil {
+		return false, err
+	}
+	return ProfilesExistWithOptions(opts)
+}
+
+// ProfilesExistWithOptions is ProfilesExist for the storage configured in opts
+func ProfilesExistWithOptions(opts SessionOptions) (bool, error) {
+	storage, err := newStorage(StorageOptions{Engine: opts.StorageEngine, FilePath: opts.StorageFilePath})
 	if err != nil {
 		return false, err
 	}
@@ -68,10 +84,19 @@ func profilesExist(storage storage) (bool, error) {
 	return false, nil
 }
 
-// NewGenesisProfile takes password and
+// NewGenesisProfile takes password and creates the first profile in the default storage in DefaultDataDir.
+// Additional profiles are created with Session.CreateProfile.
 func NewGenesisProfile(password string) error {
-	opts := StorageOptions{Engine: defaultStorageEngine}
-	storage, err := newStorage(opts)
+	opts, err := defaultSessionOptions()
+	if err != nil {
+		return err
+	}
+	return NewGenesisProfileWithOptions(password, opts)
+}
+
+// NewGenesisProfileWithOptions is NewGenesisProfile for the storage configured in opts
+func NewGenesisProfileWithOptions(password string, opts SessionOptions) error {
+	storage, err := newStorage(StorageOptions{Engine: opts.StorageEngine, FilePath: opts.StorageFilePath})
 	if err != nil {
 		return err
 	}
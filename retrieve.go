@@ -0,0 +1,358 @@
+package handshake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// retrievalWorkers is the number of peers that are checked for new messages at the same time
+const retrievalWorkers = 4
+
+// RetrievalReport holds the sorted chat log after a retrieval and the outcome for every peer that was checked
+type RetrievalReport struct {
+	Messages []Message
+	Peers    []PeerResult
+}
+
+// PeerStatus summarizes the outcome of checking one peer for new messages
+type PeerStatus string
+
+// The statuses a PeerResult can have
+const (
+	StatusUpToDate       PeerStatus = "up to date"
+	StatusNewMessages    PeerStatus = "new messages"
+	StatusNetworkError   PeerStatus = "network error"
+	StatusStaleTimestamp PeerStatus = "stale timestamp"
+	StatusMissingKey     PeerStatus = "missing key"
+	StatusDecryptFailed  PeerStatus = "decrypt failure"
+	StatusFailed         PeerStatus = "failed"
+)
+
+// PeerResult is the outcome of checking one peer for new messages. New is the number of messages added to the
+// chat log and Err is the error that stopped the retrieval from the peer, if any.
+type PeerResult struct {
+	PeerID string
+	Alias  string
+	Status PeerStatus
+	New    int
+	Err    error
+}
+
+// String describes the result for display, e.g. "alice: 2 new messages"
+func (r PeerResult) String() string {
+	switch r.Status {
+	case StatusUpToDate:
+		return fmt.Sprintf("%v: up to date", r.Alias)
+	case StatusNewMessages:
+		if r.New == 1 {
+			return fmt.Sprintf("%v: 1 new message", r.Alias)
+		}
+		return fmt.Sprintf("%v: %v new messages", r.Alias, r.New)
+	}
+	if r.New > 0 {
+		return fmt.Sprintf("%v: %v (%v new): %v", r.Alias, r.Status, r.New, r.Err)
+	}
+	return fmt.Sprintf("%v: %v: %v", r.Alias, r.Status, r.Err)
+}
+
+// peerStatus returns the status of a peer from the number of new messages and the error that stopped the retrieval
+func peerStatus(newMessages int, err error) PeerStatus {
+	var netErr net.Error
+	switch {
+	case err == nil && newMessages > 0:
+		return StatusNewMessages
+	case err == nil:
+		return StatusUpToDate
+	case errors.Is(err, ErrNodesUnavailable), errors.As(err, &netErr):
+		return StatusNetworkError
+	case errors.Is(err, ErrStaleTimestamp):
+		return StatusStaleTimestamp
+	case errors.Is(err, ErrNoKey):
+		return StatusMissingKey
+	case errors.Is(err, ErrDecryptFailed):
+		return StatusDecryptFailed
+	default:
+		return StatusFailed
+	}
+}
+
+// retrievedData is a message found at the storage of a peer under hash
+type retrievedData struct {
+	hash string
+	data payload
+}
+
+// RetrieveReport takes a chatID and checks every active peer for new messages, adding them to the chat log.
+// It returns the sorted chat log with a PeerResult for every peer, and an error if the chat could not be updated.
+func (s *Session) RetrieveReport(chatID string) (RetrievalReport, error) {
+	// this should query all peer endpoints and update the chatlog
+	// this step also runs ttl validation to clear out old messages
+	defer s.lockChat(chatID)()
+
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return RetrievalReport{}, err
+	}
+	results, err := s.retrieveFromPeers(chatID, c)
+	if err != nil {
+		return RetrievalReport{}, err
+	}
+
+	// a membership change may have made messages from other peers readable, so they are checked again
+	updated, err := s.getChat(chatID)
+	if err != nil {
+		return RetrievalReport{}, err
+	}
+	if updated.Epoch != c.Epoch {
+		retried, err := s.retrieveFromPeers(chatID, updated)
+		if err != nil {
+			return RetrievalReport{}, err
+		}
+		results = mergePeerResults(results, retried)
+		if updated, err = s.getChat(chatID); err != nil {
+			return RetrievalReport{}, err
+		}
+	}
+	// lookups of peers that left are only deleted once their remaining messages have been retrieved
+	if err := s.purgeInactiveLookups(updated); err != nil {
+		return RetrievalReport{}, err
+	}
+	if err := s.updateFetchIndex(); err != nil {
+		return RetrievalReport{}, err
+	}
+	messages, err := s.Messages(chatID)
+	if err != nil {
+		return RetrievalReport{}, err
+	}
+	for i := range results {
+		results[i].Status = peerStatus(results[i].New, results[i].Err)
+	}
+	return RetrievalReport{Messages: messages, Peers: results}, nil
+}
+
+// retrieveFromPeers checks the active peers of c for new messages, with at most retrievalWorkers peers at a time,
+// and adds everything found to the chat log in a single write. It returns a PeerResult for every peer.
+func (s *Session) retrieveFromPeers(chatID string, c chat) ([]PeerResult, error) {
+	if c.Left {
+		return nil, nil
+	}
+	cl, err := s.GetChatlog(chatID)
+	if err != nil {
+		return nil, err
+	}
+	var peers []chatPeer
+	for id, p := range c.Peers {
+		if id != c.PeerID && p.Active() { // skip self and peers that left
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Alias < peers[j].Alias
+	})
+
+	results := make([]PeerResult, len(peers))
+	found := make([][]retrievedData, len(peers))
+	workers := make(chan struct{}, retrievalWorkers)
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		results[i] = PeerResult{PeerID: p.ID, Alias: p.Alias}
+		wg.Add(1)
+		go func(i int, p chatPeer) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			found[i], results[i].Err = s.retrieveFromPeer(chatID, p, cl)
+		}(i, p)
+	}
+	wg.Wait()
+
+	// the rendezvous timestamps seen while retrieving are kept to detect replays
+	if err := s.setChat(chatID, c); err != nil {
+		return nil, err
+	}
+	if err := s.logRetrieved(chatID, peers, found, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// retrieveFromPeer follows the chain of messages of peer p, starting at its rendezvous point, until a message
+// that is already in cl. It returns the messages found, newest first, and the error that stopped it, if any.
+func (s *Session) retrieveFromPeer(chatID string, p chatPeer, cl chatLog) ([]retrievedData, error) {
+	hash, err := s.getRendezvousHash(chatID, p)
+	if err != nil {
+		return nil, err
+	}
+	var found []retrievedData
+	seen := make(map[string]bool)
+	for hash != "" && !cl.HashInLog(hash) && !seen[hash] {
+		seen[hash] = true
+		data, err := s.retrieveMessage(chatID, p, hash)
+		if errors.Is(err, ErrNoKey) && len(found) > 0 {
+			break // earlier messages were sent before the profile joined
+		}
+		if err != nil {
+			return found, err
+		}
+		found = append(found, retrievedData{hash: hash, data: data})
+		hash = data.Parent
+	}
+	return found, nil
+}
+
+// getRendezvousHash returns the hash of the latest message of peer p, or an empty string if the peer has not
+// sent anything yet or its rendezvous point did not change since the last retrieval
+func (s *Session) getRendezvousHash(chatID string, p chatPeer) (string, error) {
+	h, isHashmap := p.Strategy.Rendezvous.(*hashmapStorage)
+	var latest int64
+	if isHashmap {
+		latest = h.Latest
+	}
+	rBytes, err := p.Strategy.Rendezvous.Get("")
+	if err != nil {
+		return "", err
+	}
+	if len(rBytes) <= lookupHashLength {
+		return "", nil
+	}
+	if isHashmap && h.Latest == latest {
+		return "", nil // the key for this payload was used by an earlier retrieval
+	}
+	hash, err := s.decryptRendezvous(chatID, p, rBytes)
+	if err != nil && isHashmap {
+		// the payload is read again next time, as a membership change may provide the missing key
+		h.Latest = latest
+	}
+	return hash, err
+}
+
+// decryptRendezvous decrypts the message hash in the rendezvous payload rBytes of peer p
+func (s *Session) decryptRendezvous(chatID string, p chatPeer, rBytes []byte) (string, error) {
+	rHash := base64.StdEncoding.EncodeToString(rBytes[:lookupHashLength])
+	var rKey []byte
+	err := s.updateLookup(chatID, p.ID, func(l lookup) error {
+		if rKey = l.popKey(rHash); len(rKey) == 0 {
+			return ErrNoKey
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	hashBytes, err := p.Strategy.Cipher.Decrypt(rBytes[lookupHashLength:], rKey)
+	if err != nil {
+		return "", err
+	}
+	return string(hashBytes), nil
+}
+
+// retrieveMessage gets the message stored under hash by peer p and decrypts it with a key from its lookup
+func (s *Session) retrieveMessage(chatID string, p chatPeer, hash string) (data payload, err error) {
+	b, err := p.Strategy.Storage.Get(hash)
+	if err != nil {
+		return
+	}
+	if len(b) <= lookupHashLength {
+		return data, errors.New("invalid message payload")
+	}
+	lookupHash := base64.StdEncoding.EncodeToString(b[:lookupHashLength])
+	var key []byte
+	remaining := 0
+	err = s.updateLookup(chatID, p.ID, func(l lookup) error {
+		if key = l.popKey(lookupHash); len(key) == 0 {
+			return ErrNoKey
+		}
+		remaining = len(l)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	s.checkKeys(chatID, p.ID, remaining)
+	d, err := p.Strategy.Cipher.Decrypt(b[lookupHashLength:], key)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(d, &data)
+	return
+}
+
+// logRetrieved adds the messages found for every peer to the chat log in a single write. Membership changes are
+// then applied and MessageEvents sent in the order the messages were sent. The number of new messages and any
+// error applying a membership change are recorded in results.
+func (s *Session) logRetrieved(chatID string, peers []chatPeer, found [][]retrievedData, results []PeerResult) error {
+	cl, err := s.GetChatlog(chatID)
+	if err != nil {
+		return err
+	}
+	type logged struct {
+		peer  int
+		entry Message
+		data  payload
+	}
+	var entries []logged
+	for i, p := range peers {
+		for _, r := range found[i] {
+			entry := Message{
+				ID:     r.hash,
+				Sender: p.ID,
+				Sent:   r.data.Timestamp,
+				TTL:    r.data.TTL,
+				Data:   r.data.redacted(),
+			}
+			if err := cl.AddEntry(entry); err != nil {
+				if results[i].Err == nil {
+					results[i].Err = err
+				}
+				continue
+			}
+			entries = append(entries, logged{peer: i, entry: entry, data: r.data})
+			results[i].New++
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := s.setChatlog(chatID, cl); err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].entry.Sent < entries[j].entry.Sent
+	})
+	for _, e := range entries {
+		if e.data.Control == nil {
+			s.emit(MessageEvent{ChatID: chatID, Message: e.entry})
+			continue
+		}
+		err := s.applyControl(chatID, e.entry.Sender, e.data.Timestamp, *e.data.Control)
+		if err != nil && results[e.peer].Err == nil {
+			results[e.peer].Err = err
+		}
+	}
+	return nil
+}
+
+// mergePeerResults adds the results of a second retrieval to the first, keeping the latest error of each peer
+func mergePeerResults(results, retried []PeerResult) []PeerResult {
+	index := make(map[string]int)
+	for i, r := range results {
+		index[r.PeerID] = i
+	}
+	for _, r := range retried {
+		i, ok := index[r.PeerID]
+		if !ok {
+			index[r.PeerID] = len(results)
+			results = append(results, r)
+			continue
+		}
+		results[i].New += r.New
+		results[i].Err = r.Err
+	}
+	return results
+}
@@ -0,0 +1,117 @@
+package handshake
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRetrieveReport(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-report.boltdb", "bob-report.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	for i := 0; i < 3; i++ {
+		if _, err := bob.Send(bobChatID, MessageData{Message: fmt.Sprintf("message %v", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := alice.RetrieveReport(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Messages) != 3 || report.Messages[0].Data.Message != "message 0" {
+		t.Errorf("expected the three messages in order, got %+v", report.Messages)
+	}
+	if len(report.Peers) != 1 || report.Peers[0].New != 3 || report.Peers[0].Err != nil {
+		t.Errorf("unexpected peer results %+v", report.Peers)
+	}
+
+	report, err = alice.RetrieveReport(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Messages) != 3 || len(report.Peers) != 1 || report.Peers[0].Status != StatusUpToDate {
+		t.Errorf("expected no new messages, got %+v", report.Peers)
+	}
+}
+
+func TestRetrieveReportStatus(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-status.boltdb", "bob-status.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	status := func() PeerResult {
+		report, err := alice.RetrieveReport(aliceChatID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Peers) != 1 {
+			t.Fatalf("expected one peer result, got %+v", report.Peers)
+		}
+		return report.Peers[0]
+	}
+
+	if r := status(); r.Status != StatusUpToDate {
+		t.Errorf("expected %q before bob sent anything, got %v", StatusUpToDate, r)
+	}
+	n.setOffline(true)
+	if r := status(); r.Status != StatusNetworkError || !errors.Is(r.Err, ErrNodesUnavailable) {
+		t.Errorf("expected %q while offline, got %v", StatusNetworkError, r)
+	}
+	n.setOffline(false)
+	if _, err := bob.Send(bobChatID, MessageData{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if r := status(); r.Status != StatusNewMessages || r.New != 1 {
+		t.Errorf("expected one new message, got %v", r)
+	}
+	if r := status(); r.Status != StatusUpToDate {
+		t.Errorf("expected %q after reading the message, got %v", StatusUpToDate, r)
+	}
+}
+
+func TestPeerStatus(t *testing.T) {
+	tests := []struct {
+		new  int
+		err  error
+		want PeerStatus
+	}{
+		{0, nil, StatusUpToDate},
+		{2, nil, StatusNewMessages},
+		{0, fmt.Errorf("rendezvous: %w", ErrNodesUnavailable), StatusNetworkError},
+		{0, ErrStaleTimestamp, StatusStaleTimestamp},
+		{1, ErrNoKey, StatusMissingKey},
+		{0, ErrDecryptFailed, StatusDecryptFailed},
+		{0, errors.New("invalid message payload"), StatusFailed},
+	}
+	for _, tt := range tests {
+		if got := peerStatus(tt.new, tt.err); got != tt.want {
+			t.Errorf("peerStatus(%v, %v) = %q, want %q", tt.new, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMergePeerResults(t *testing.T) {
+	results := []PeerResult{{PeerID: "a", New: 2}, {PeerID: "b", Err: ErrNoKey}}
+	retried := []PeerResult{{PeerID: "b", New: 1}, {PeerID: "c", New: 1}}
+	merged := mergePeerResults(results, retried)
+	if len(merged) != 3 || merged[0].New != 2 || merged[1].New != 1 || merged[1].Err != nil || merged[2].PeerID != "c" {
+		t.Errorf("unexpected merged results %+v", merged)
+	}
+}
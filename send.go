@@ -0,0 +1,282 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// sendAttempts is the number of times each upload of a send is tried before the send is left pending
+const sendAttempts = 3
+
+// sendRetryDelay is the delay before the second attempt of an upload, it grows with every further attempt
+var sendRetryDelay = 500 * time.Millisecond
+
+// pendingSend is a send that reserved its keys but is not committed yet. Unless it holds a membership change, it is
+// stored encrypted under chats/<chatID>/<profileID>/pending before anything is uploaded, so an interrupted send can
+// be resumed with the same keys. The keys stay in the lookup until the send is committed, and the rendezvous key is kept here as well
+// so the send can be completed after a membership change replaced the lookup.
+type pendingSend struct {
+	Data            payload // Parent, Timestamp and TTL are set when the send is staged
+	MessageKey      string  // the lookup hash of the message key
+	Payload         []byte  // the encrypted message, uploaded unchanged on every attempt
+	RendezvousKey   string  // the lookup hash of the rendezvous key
+	RendezvousValue []byte  // the rendezvous key, kept in case the lookup is replaced before the send completes
+	Hash            string  // the storage hash of the message, set once it is uploaded
+	Published       bool    // set once the rendezvous point points to Hash
+	OutboxID        string  // the ID of the queued message, which is removed from the outbox on commit
+}
+
+// sendChatData encrypts the membership change control and submits it to the message storage and rendezvous point
+// of the profile user. An interrupted send and the messages in the outbox are sent first, so control is sent after
+// them. It returns the updated chatLog and an error
+func (s *Session) sendChatData(chatID string, control chatControl) (chatLog, error) {
+	if err := s.flushOutbox(chatID); err != nil {
+		return chatLog{}, err
+	}
+	p, err := s.stageSend(chatID, payload{Control: &control}, "")
+	if err != nil {
+		return chatLog{}, err
+	}
+	if err := s.completeSend(chatID, p); err != nil {
+		// the caller only saves the membership change once it is sent, so a failed send is discarded rather than
+		// resumed later with keys and a rendezvous point nobody kept
+		if dErr := s.discardSend(chatID, p); dErr != nil {
+			return chatLog{}, dErr
+		}
+		return chatLog{}, err
+	}
+	return s.GetChatlog(chatID)
+}
+
+// discardSend drops a send that is not resumed. If its message may have been uploaded, its keys are removed from
+// the lookup so they are never used for another message.
+func (s *Session) discardSend(chatID string, p pendingSend) error {
+	defer wipeBytes(p.RendezvousValue)
+	if p.Hash == "" {
+		return nil
+	}
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	return s.updateLookup(chatID, c.PeerID, func(l lookup) error {
+		l.popKey(p.MessageKey)
+		l.popKey(p.RendezvousKey)
+		return nil
+	})
+}
+
+// resumable reports whether p is saved so it can be completed later. Membership changes are not, as the caller
+// saves the change only after it was sent.
+func (p pendingSend) resumable() bool {
+	return p.Data.Control == nil
+}
+
+// resumeSend completes the pending send of chatID, if there is one
+func (s *Session) resumeSend(chatID string) error {
+	p, ok, err := s.getPendingSend(chatID)
+	if err != nil || !ok {
+		return err
+	}
+	return s.completeSend(chatID, p)
+}
+
+// stageSend reserves a message and a rendezvous key for data, encrypts it and saves the pendingSend. outboxID is
+// the ID of the queued message data was taken from, or empty.
+func (s *Session) stageSend(chatID string, data payload, outboxID string) (pendingSend, error) {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return pendingSend{}, err
+	}
+	data.Parent = c.LastSent
+	data.Timestamp = time.Now().UnixNano()
+	data.TTL = c.TTL()
+
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return pendingSend{}, err
+	}
+
+	l, err := s.getLookup(chatID, c.PeerID)
+	if err != nil {
+		return pendingSend{}, err
+	}
+	// a message and a rendezvous key are used for each send
+	if len(l) < 2 {
+		return pendingSend{}, ErrLookupExhausted
+	}
+	mStoreKey, mStoreValue := l.popRandom()
+	rStoreKey, rStoreValue := l.getRandom()
+
+	mStoreKeyBytes, err := base64.StdEncoding.DecodeString(mStoreKey)
+	if err != nil {
+		return pendingSend{}, err
+	}
+	cipherText, err := c.Peers[c.PeerID].Strategy.Cipher.Encrypt(dataBytes, mStoreValue)
+	if err != nil {
+		return pendingSend{}, err
+	}
+
+	p := pendingSend{
+		Data:            data,
+		MessageKey:      mStoreKey,
+		Payload:         append(mStoreKeyBytes, cipherText...),
+		RendezvousKey:   rStoreKey,
+		RendezvousValue: rStoreValue,
+		OutboxID:        outboxID,
+	}
+	if err := s.savePendingSend(chatID, p); err != nil {
+		return pendingSend{}, err
+	}
+	return p, nil
+}
+
+// completeSend uploads the message of p and updates the rendezvous point, saving the progress after each step.
+// Once both are written, the keys are removed from the lookup, LastSent and the chat log are updated and the
+// pendingSend is deleted. Every step can be repeated, so an interrupted send is completed by calling it again.
+func (s *Session) completeSend(chatID string, p pendingSend) error {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	sender := c.Peers[c.PeerID]
+
+	if p.Hash == "" {
+		err := retry(func() (err error) {
+			p.Hash, err = sender.Strategy.Storage.Set("", p.Payload)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.savePendingSend(chatID, p); err != nil {
+			return err
+		}
+	}
+
+	if !p.Published {
+		rStoreKeyBytes, err := base64.StdEncoding.DecodeString(p.RendezvousKey)
+		if err != nil {
+			return err
+		}
+		rCipherText, err := sender.Strategy.Cipher.Encrypt([]byte(p.Hash), p.RendezvousValue)
+		if err != nil {
+			return err
+		}
+		rPayload := append(rStoreKeyBytes, rCipherText...)
+		err = retry(func() error {
+			_, err := sender.Strategy.Rendezvous.Set("", rPayload)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		p.Published = true
+		if err := s.savePendingSend(chatID, p); err != nil {
+			return err
+		}
+	}
+
+	return s.commitSend(chatID, c, p)
+}
+
+// commitSend removes the keys used by p from the lookup, records the message as the last one sent and adds it to
+// the chat log. The message is then removed from the outbox before the pendingSend is deleted.
+func (s *Session) commitSend(chatID string, c chat, p pendingSend) error {
+	remaining := 0
+	err := s.updateLookup(chatID, c.PeerID, func(l lookup) error {
+		l.popKey(p.MessageKey)
+		l.popKey(p.RendezvousKey)
+		remaining = len(l)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.LastSent = p.Hash
+	if err := s.setChat(chatID, c); err != nil {
+		return err
+	}
+
+	cl, err := s.GetChatlog(chatID)
+	if err != nil {
+		return err
+	}
+	clEntry := Message{
+		ID:     p.Hash,
+		Sender: c.PeerID,
+		Sent:   p.Data.Timestamp,
+		TTL:    p.Data.TTL,
+		Data:   p.Data.redacted(),
+	}
+	if err := cl.AddEntry(clEntry); err != nil {
+		return err
+	}
+	if err := s.setChatlog(chatID, cl); err != nil {
+		return err
+	}
+	if p.OutboxID != "" {
+		if err := s.removeFromOutbox(chatID, p.OutboxID); err != nil {
+			return err
+		}
+	}
+	if p.resumable() {
+		if err := s.storage.Delete(s.pendingSendKey(chatID)); err != nil {
+			return err
+		}
+	}
+	s.checkKeys(chatID, c.PeerID, remaining)
+	return nil
+}
+
+func (s *Session) pendingSendKey(chatID string) string {
+	return fmt.Sprintf("chats/%v/%v/pending", chatID, s.profileID())
+}
+
+// getPendingSend returns the pendingSend of chatID and whether there is one
+func (s *Session) getPendingSend(chatID string) (pendingSend, bool, error) {
+	encrypted, err := s.storage.Get(s.pendingSendKey(chatID))
+	if err != nil || len(encrypted) == 0 {
+		return pendingSend{}, false, err
+	}
+	pendingGob, err := s.decrypt(encrypted)
+	if err != nil {
+		return pendingSend{}, false, err
+	}
+	var p pendingSend
+	if err := gob.NewDecoder(bytes.NewBuffer(pendingGob)).Decode(&p); err != nil {
+		return pendingSend{}, false, err
+	}
+	return p, true, nil
+}
+
+// savePendingSend stores p if it is resumable
+func (s *Session) savePendingSend(chatID string, p pendingSend) error {
+	if !p.resumable() {
+		return nil
+	}
+	pendingGob, err := encodeGob(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.set(s.pendingSendKey(chatID), pendingGob)
+	return err
+}
+
+// retry calls fn until it succeeds or sendAttempts is reached, waiting longer after every failure
+func retry(fn func() error) (err error) {
+	for i := 0; i < sendAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * sendRetryDelay)
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
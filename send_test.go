@@ -0,0 +1,74 @@
+package handshake
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendResumesAfterFailure(t *testing.T) {
+	defer func(delay time.Duration) { sendRetryDelay = delay }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-resume.boltdb", "bob-resume.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	c, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.setOffline(true)
+	_, err = alice.Send(aliceChatID, MessageData{Message: "first"})
+	if !errors.Is(err, ErrNodesUnavailable) || !errors.Is(err, ErrMessagePending) {
+		t.Fatalf("expected %v while offline, got %v", ErrNodesUnavailable, err)
+	}
+	after, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected no keys to be used by a failed send, %v keys left of %v", len(after), len(before))
+	}
+	if c, err = alice.getChat(aliceChatID); err != nil || c.LastSent != "" {
+		t.Errorf("expected LastSent to be unchanged, got %q, %v", c.LastSent, err)
+	}
+	if _, ok, err := alice.getPendingSend(aliceChatID); !ok || err != nil {
+		t.Fatalf("expected the failed send to be pending, got %v, %v", ok, err)
+	}
+
+	n.setOffline(false)
+	messages, err := alice.Send(aliceChatID, MessageData{Message: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Data.Message != "first" || messages[1].Data.Message != "second" {
+		t.Fatalf("expected the pending message to be sent first, got %+v", messages)
+	}
+	if _, ok, _ := alice.getPendingSend(aliceChatID); ok {
+		t.Error("expected the pending send to be deleted once committed")
+	}
+	if after, err = alice.getLookup(aliceChatID, c.PeerID); err != nil || len(after) != len(before)-4 {
+		t.Errorf("expected two sends to use four keys, %v keys left of %v", len(after), len(before))
+	}
+
+	received, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 || received[0].Data.Message != "first" || received[1].Data.Message != "second" {
+		t.Errorf("expected bob to receive both messages in order, got %+v", received)
+	}
+}
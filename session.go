@@ -2,12 +2,15 @@ package handshake
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,12 +19,20 @@ const (
 	DefaultSessionTTL = 15 * 60 // 15 minutes in seconds
 	// DefaultMaxLoginAttempts is the number of times failed login attempts are allowed
 	DefaultMaxLoginAttempts = 10
-	chatIDLength            = 12
-	defaultLookupCount      = 10000
+	// DefaultLockoutDuration is the default time in seconds that logins are refused after MaxLoginAttempts
+	DefaultLockoutDuration = 15 * 60 // 15 minutes in seconds
+	// LockoutTimeout refuses all logins for the lockout duration once MaxLoginAttempts is reached
+	LockoutTimeout LockoutAction = "timeout"
+	// LockoutWipe securely deletes all profiles and chats once MaxLoginAttempts is reached
+	LockoutWipe LockoutAction = "wipe"
+
+	chatIDLength       = 12
+	defaultLookupCount = 10000
 )
 
 // Session is the primary struct for a logged in  user. It holds the profile data
 // as well as settings information
+// A Session is safe for concurrent use. Methods that change a chat are serialized per chat.
 type Session struct {
 	profile         Profile
 	storage         storage
@@ -30,6 +41,15 @@ type Session struct {
 	startTime       int64
 	globalConfig    globalConfig
 	activeHandshake *handshake
+	mu              sync.RWMutex // guards the profile key, startTime and globalConfig
+	handshakeMu     sync.Mutex   // guards activeHandshake
+	globalMu        sync.Mutex   // serializes updates of the stored globalConfig
+	fetchMu         sync.Mutex   // serializes updates of the global/fetch index
+	chatLocksMu     sync.Mutex
+	chatLocks       map[string]*sync.Mutex
+	subscribersMu   sync.Mutex
+	subscribers     map[int]func(Event)
+	nextSubscriber  int
 }
 
 // SessionOptions holds session options for initialization
@@ -38,12 +58,26 @@ type SessionOptions struct {
 	StorageFilePath string
 }
 
+// LockoutAction is the action taken once MaxLoginAttempts failed logins have been made
+type LockoutAction string
+
+var (
+	// loginDelayBase is the delay before a login attempt after the first failed attempt, it doubles with
+	// every further failure up to maxLoginDelay
+	loginDelayBase = 500 * time.Millisecond
+	maxLoginDelay  = 30 * time.Second
+)
+
 // GlobalConfig holds global settings used by the app
 // These may end up just being global constants.
 type globalConfig struct {
 	TTL                 int
 	FailedLoginAttempts int
 	MaxLoginAttempts    int
+	LockoutAction       LockoutAction
+	LockoutDuration     int64
+	LockedUntil         int64
+	FetchIndex          bool
 }
 
 // newGlobalConfig creates a new global config struct with default settings.
@@ -53,6 +87,8 @@ func newGlobalConfig() globalConfig {
 		TTL:                 DefaultSessionTTL,
 		FailedLoginAttempts: 0,
 		MaxLoginAttempts:    DefaultMaxLoginAttempts,
+		LockoutAction:       LockoutTimeout,
+		LockoutDuration:     DefaultLockoutDuration,
 	}
 }
 
@@ -62,6 +98,119 @@ func (g globalConfig) ToJSON() []byte {
 	return b
 }
 
+// loginDelay returns the time to wait before a login attempt, based on the number of failed attempts
+func (g globalConfig) loginDelay() time.Duration {
+	if g.FailedLoginAttempts <= 0 {
+		return 0
+	}
+	delay := loginDelayBase
+	for i := 1; i < g.FailedLoginAttempts && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+	return delay
+}
+
+// getGlobalConfig reads the unencrypted globalConfig from storage
+func getGlobalConfig(storage storage) (globalConfig, error) {
+	g := newGlobalConfig()
+	b, err := storage.Get(globalConfigKey)
+	if err != nil {
+		return g, err
+	}
+	if len(b) == 0 {
+		return g, nil
+	}
+	err = json.Unmarshal(b, &g)
+	return g, err
+}
+
+// updateStoredGlobalConfig applies fn to the globalConfig in storage and saves it in a single transaction, so
+// concurrent logins never overwrite each other's changes. It returns the saved globalConfig.
+func updateStoredGlobalConfig(storage storage, fn func(g *globalConfig)) (globalConfig, error) {
+	u, ok := storage.(updateStorage)
+	if !ok {
+		return globalConfig{}, errors.New("storage does not support atomic updates")
+	}
+	var g globalConfig
+	err := u.update(globalConfigKey, func(b []byte) ([]byte, error) {
+		g = newGlobalConfig()
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &g); err != nil {
+				return nil, err
+			}
+		}
+		fn(&g)
+		return g.ToJSON(), nil
+	})
+	return g, err
+}
+
+// attemptLogin refuses logins while they are locked out and waits the delay earned by earlier failures before
+// calling try, which reports whether the password was accepted. A rejected password is counted with
+// recordFailedLogin and an accepted one resets the counter. It returns the globalConfig after a successful login.
+func attemptLogin(storage storage, try func() (bool, error)) (globalConfig, error) {
+	g, err := getGlobalConfig(storage)
+	if err != nil {
+		return g, err
+	}
+	if g.LockedUntil > time.Now().Unix() {
+		return g, ErrLoginLocked
+	}
+	time.Sleep(g.loginDelay())
+	ok, err := try()
+	if err != nil {
+		return g, err
+	}
+	if !ok {
+		return g, recordFailedLogin(storage)
+	}
+	return updateStoredGlobalConfig(storage, func(g *globalConfig) {
+		g.FailedLoginAttempts = 0
+		g.LockedUntil = 0
+	})
+}
+
+// recordFailedLogin increments the failed login counter and runs the LockoutAction once MaxLoginAttempts
+// is reached. It returns the error to report for the failed login.
+func recordFailedLogin(storage storage) error {
+	var wipe, locked bool
+	_, err := updateStoredGlobalConfig(storage, func(g *globalConfig) {
+		g.FailedLoginAttempts++
+		if g.MaxLoginAttempts <= 0 || g.FailedLoginAttempts < g.MaxLoginAttempts {
+			return
+		}
+		if g.LockoutAction == LockoutWipe {
+			// the counter is only reset once the wipe is done, so an interrupted wipe runs again
+			wipe = true
+			return
+		}
+		g.FailedLoginAttempts = 0
+		g.LockedUntil = time.Now().Unix() + g.LockoutDuration
+		locked = true
+	})
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrLoginLocked
+	}
+	if wipe {
+		if err := wipeProfiles(storage); err != nil {
+			return err
+		}
+		_, err := updateStoredGlobalConfig(storage, func(g *globalConfig) {
+			g.FailedLoginAttempts = 0
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return ErrInvalidPassword
+}
+
 // NewSession takes a password and opts and returns a pointer to Session and an error
 func NewSession(password string, opts SessionOptions) (*Session, error) {
 	storageOpts := StorageOptions{Engine: opts.StorageEngine}
@@ -71,6 +220,17 @@ func NewSession(password string, opts SessionOptions) (*Session, error) {
 		return nil, err
 	}
 
+	session, err := newSession(password, storage)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// newSession tries password against every profile in storage. Failed attempts are counted in the globalConfig,
+// each one adding to the delay before the next attempt, until the LockoutAction is run.
+func newSession(password string, storage storage) (*Session, error) {
 	cipher := newTimeSeriesSBCipher()
 	session := Session{
 		storage:   storage,
@@ -84,28 +244,145 @@ func NewSession(password string, opts SessionOptions) (*Session, error) {
 		return nil, err
 	}
 	if len(profilePaths) == 0 {
-		return nil, errors.New("no profile found")
+		return nil, ErrNoProfile
+	}
+	var profile Profile
+	g, err := attemptLogin(storage, func() (ok bool, err error) {
+		profile, ok, err = findProfile(password, profilePaths, cipher, storage)
+		return
+	})
+	if err != nil {
+		return nil, err
 	}
+	if profile, err = openDuress(profile, password, cipher, storage); err != nil {
+		return nil, err
+	}
+	session.setProfile(profile)
+	session.globalConfig = g
+	if err := session.expireHandshake(); err != nil {
+		session.wipeKey()
+		return nil, err
+	}
+	return &session, nil
+}
+
+// openDuress runs the duress action of profile, if it has one. With DuressWipe, it returns the new empty profile
+// created by wipeForDuress. The duress setting is cleared, so a decoy session can not be told apart from a
+// normal one.
+func openDuress(profile Profile, password string, cipher cipher, storage storage) (Profile, error) {
+	if profile.Settings.Duress == DuressWipe {
+		wipeBytes(profile.Key)
+		var err error
+		if profile, err = wipeForDuress(password, cipher, storage); err != nil {
+			return Profile{}, err
+		}
+	}
+	profile.Settings.Duress = ""
+	return profile, nil
+}
+
+// findProfile tries password against every profile in profilePaths. It returns the first profile that decrypts
+// and true, or false if the password opens no profile.
+func findProfile(password string, profilePaths []string, cipher cipher, storage storage) (Profile, bool, error) {
 	for _, profilePath := range profilePaths {
 		id, err := getIDFromPath(profilePath)
 		if err != nil {
-			return nil, err
+			return Profile{}, false, err
 		}
 		key := deriveKey([]byte(password), id)
 		profile, err := getProfileFromEncryptedStorage(profilePath, key, cipher, storage)
 		if err == nil {
-			session.setProfile(profile)
-			return &session, err
+			return profile, true, nil
 		}
 	}
+	return Profile{}, false, nil
+}
+
+// wipeForDuress securely deletes every profile and chat, then creates an empty profile for password so that
+// the login looks like any other.
+func wipeForDuress(password string, cipher cipher, storage storage) (Profile, error) {
+	if err := wipeProfiles(storage); err != nil {
+		return Profile{}, err
+	}
+	profile := generateRandomProfile()
+	if err := initProfile(profile, password, cipher, storage); err != nil {
+		return Profile{}, err
+	}
+	return profile, nil
+}
+
+// SetLockoutPolicy sets the number of failed logins allowed before action is run and, for LockoutTimeout, the
+// number of seconds that logins are refused. A maxAttempts of 0 disables the lockout.
+func (s *Session) SetLockoutPolicy(maxAttempts int, action LockoutAction, duration int64) error {
+	if err := s.checkSession(); err != nil {
+		return err
+	}
+	if maxAttempts < 0 || duration < 0 {
+		return errors.New("invalid lockout policy")
+	}
+	switch action {
+	case LockoutTimeout, LockoutWipe:
+	default:
+		return fmt.Errorf("unknown lockout action: %v", action)
+	}
+	return s.updateGlobalConfig(func(g *globalConfig) {
+		g.MaxLoginAttempts = maxAttempts
+		g.LockoutAction = action
+		g.LockoutDuration = duration
+	})
+}
 
-	return nil, errors.New("invalid password")
+// updateGlobalConfig applies fn to the stored globalConfig and saves it
+func (s *Session) updateGlobalConfig(fn func(g *globalConfig)) error {
+	s.globalMu.Lock()
+	defer s.globalMu.Unlock()
+	g, err := updateStoredGlobalConfig(s.storage, fn)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.globalConfig = g
+	s.mu.Unlock()
+	return nil
 }
 
-// NewDefaultSession is a wrapper around NewSession and applies simple defaults. This is intended to be used
-//by the reference apps.
+// DefaultDataDir returns the XDG-style directory for handshake data, $XDG_DATA_HOME/handshake or
+// ~/.local/share/handshake if XDG_DATA_HOME is not set.
+func DefaultDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "handshake"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "handshake"), nil
+}
+
+// NewSessionOptions returns SessionOptions for the default storage engine with its file in dataDir
+func NewSessionOptions(dataDir string) SessionOptions {
+	return SessionOptions{
+		StorageEngine:   defaultStorageEngine,
+		StorageFilePath: filepath.Join(dataDir, defaultBoltFilePath),
+	}
+}
+
+// defaultSessionOptions returns the SessionOptions for the default storage engine in DefaultDataDir
+func defaultSessionOptions() (SessionOptions, error) {
+	dataDir, err := DefaultDataDir()
+	if err != nil {
+		return SessionOptions{}, err
+	}
+	return NewSessionOptions(dataDir), nil
+}
+
+// NewDefaultSession is a wrapper around NewSession and applies simple defaults, with the storage file in
+// DefaultDataDir. This is intended to be used by the reference apps.
 func NewDefaultSession(password string) (*Session, error) {
-	opts := SessionOptions{StorageEngine: defaultStorageEngine}
+	opts, err := defaultSessionOptions()
+	if err != nil {
+		return nil, err
+	}
 	return NewSession(password, opts)
 }
 
@@ -114,9 +391,159 @@ func (s *Session) setProfile(p Profile) {
 	s.profile = p
 }
 
-// GetProfile returns the profile in the Session struct
-func (s *Session) GetProfile() Profile {
-	return s.profile
+// GetProfile returns the profile of the session, including its key. It returns ErrSessionExpired once the session
+// is locked or its TTL has passed.
+func (s *Session) GetProfile() (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkKey(); err != nil {
+		s.wipeKey()
+		return Profile{}, err
+	}
+	return s.profile, nil
+}
+
+// profileID returns the ID of the session profile, which is also known while the session is locked. Unlock may
+// replace the profile, so the ID is read under mu. Callers that hold mu read s.profile directly.
+func (s *Session) profileID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profile.ID
+}
+
+// sessionTTL returns the TTL of the session in seconds, preferring the profile setting when it is set
+func (s *Session) sessionTTL() int64 {
+	if s.profile.Settings.SessionTTL > 0 {
+		return s.profile.Settings.SessionTTL
+	}
+	return s.ttl
+}
+
+// checkKey returns ErrSessionExpired if the profile key was wiped or the TTL has passed. The caller must hold mu.
+func (s *Session) checkKey() error {
+	if len(s.profile.Key) == 0 || time.Now().Unix()-s.startTime > s.sessionTTL() {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+// rlockKey read-locks mu for a use of the profile key and returns the function that unlocks it. If the session
+// expired, the key is wiped under the write lock and ErrSessionExpired is returned with mu unlocked.
+func (s *Session) rlockKey() (unlock func(), err error) {
+	s.mu.RLock()
+	if err := s.checkKey(); err == nil {
+		return s.mu.RUnlock, nil
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	if err := s.checkKey(); err != nil {
+		s.wipeKey()
+		s.mu.Unlock()
+		return nil, err
+	}
+	// the session was unlocked while mu was released
+	return s.mu.Unlock, nil
+}
+
+// checkSession returns ErrSessionExpired if the session is locked. A session whose TTL has passed is locked first.
+func (s *Session) checkSession() error {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	return s.checkSessionLocked()
+}
+
+// checkSessionLocked is checkSession for callers that hold handshakeMu
+func (s *Session) checkSessionLocked() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.checkKey()
+	if err != nil {
+		s.wipeKey()
+		s.wipeActiveHandshake()
+	}
+	return err
+}
+
+// wipeKey wipes the profile key from memory. The caller must hold mu.
+func (s *Session) wipeKey() {
+	wipeBytes(s.profile.Key)
+	s.profile.Key = nil
+}
+
+// Lock wipes the profile key and the ActiveHandshake from memory. The persisted handshake is kept, so it can be
+// resumed after Unlock.
+func (s *Session) Lock() {
+	s.mu.Lock()
+	s.wipeKey()
+	s.mu.Unlock()
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	s.wipeActiveHandshake()
+}
+
+// Unlock takes the password of the session profile and re-authenticates a locked or expired session, restarting
+// its TTL. It returns an error if the password is invalid. Attempts are counted and delayed like logins with
+// NewSession. A duress password runs its duress action like it does at login, and the session continues with the
+// profile it opens.
+func (s *Session) Unlock(password string) error {
+	profilePaths, err := s.storage.List(profileKeyPrefix)
+	if err != nil {
+		return err
+	}
+	sessionID := s.profileID()
+	var profile Profile
+	g, err := attemptLogin(s.storage, func() (bool, error) {
+		p, ok, err := findProfile(password, profilePaths, s.cipher, s.storage)
+		if err != nil || !ok {
+			return false, err
+		}
+		// the password of another profile does not unlock this session
+		if p.ID != sessionID && p.Settings.Duress == "" {
+			wipeBytes(p.Key)
+			return false, nil
+		}
+		profile = p
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if profile, err = openDuress(profile, password, s.cipher, s.storage); err != nil {
+		return err
+	}
+	if profile.ID != sessionID {
+		s.handshakeMu.Lock()
+		s.wipeActiveHandshake()
+		s.handshakeMu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wipeKey()
+	s.profile = profile
+	s.globalConfig = g
+	s.startTime = time.Now().Unix()
+	return nil
+}
+
+// Touch extends an active session by restarting its TTL. It returns ErrSessionExpired if the session already expired.
+func (s *Session) Touch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkKey(); err != nil {
+		s.wipeKey()
+		return err
+	}
+	s.startTime = time.Now().Unix()
+	return nil
+}
+
+// ReleaseStorage closes the storage file, so other processes can use the data dir while the session is idle.
+// Storage writes in progress finish first, and the next Session call that needs storage opens it again.
+func (s *Session) ReleaseStorage() error {
+	if r, ok := s.storage.(releaseStorage); ok {
+		return r.release()
+	}
+	return nil
 }
 
 // Close gracefully closes the session
@@ -126,60 +553,288 @@ func (s *Session) Close() error {
 
 // NewInitiatorWithDefaults provides a simple method with no arguments to create a default handshake
 // for an initiator. Adds this handshake pointer to the ActiveHandshake in the session.
-func (s *Session) NewInitiatorWithDefaults() {
-	s.activeHandshake = newHandshakeInitiatorWithDefaults()
+func (s *Session) NewInitiatorWithDefaults() error {
+	return s.startHandshake(newHandshakeInitiatorWithDefaults())
 }
 
 // NewPeerWithDefaults provides a simple method with no arguments to create a default handshake
 // for an peer. Adds this handshake pointer to the ActiveHandshake in the session.
-func (s *Session) NewPeerWithDefaults() {
-	s.activeHandshake = newHandshakePeerWithDefaults()
+func (s *Session) NewPeerWithDefaults() error {
+	return s.startHandshake(newHandshakePeerWithDefaults())
+}
+
+// NewInitiator creates a handshake for an initiator using the strategy described in def.
+// Adds this handshake pointer to the ActiveHandshake in the session.
+func (s *Session) NewInitiator(def StrategyDefinition) error {
+	strategy, err := def.strategy()
+	if err != nil {
+		return err
+	}
+	return s.startHandshake(newHandshake(strategy, handshakeOptions{Role: initiator}))
+}
+
+// NewPeer creates a handshake for a peer using the strategy described in def.
+// Adds this handshake pointer to the ActiveHandshake in the session.
+func (s *Session) NewPeer(def StrategyDefinition) error {
+	strategy, err := def.strategy()
+	if err != nil {
+		return err
+	}
+	return s.startHandshake(newHandshake(strategy, handshakeOptions{Role: peer}))
+}
+
+// startHandshake replaces the ActiveHandshake with h, destroying any handshake in progress, and persists it.
+func (s *Session) startHandshake(h *handshake) error {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if err := s.checkSessionLocked(); err != nil {
+		h.wipe()
+		return err
+	}
+	s.wipeActiveHandshake()
+	s.activeHandshake = h
+	return s.saveHandshake()
+}
+
+// getActiveHandshake returns the ActiveHandshake or an error if no handshake is in progress or it has expired.
+// An expired handshake is abandoned. The caller must hold handshakeMu.
+func (s *Session) getActiveHandshake() (*handshake, error) {
+	if err := s.checkSessionLocked(); err != nil {
+		return nil, err
+	}
+	if s.activeHandshake == nil {
+		return nil, ErrNoHandshake
+	}
+	if s.activeHandshake.Expired() {
+		if err := s.abandonHandshake(); err != nil {
+			return nil, fmt.Errorf("%w, deleting it failed: %v", ErrHandshakeExpired, err)
+		}
+		return nil, ErrHandshakeExpired
+	}
+	return s.activeHandshake, nil
+}
+
+// handshakeRole returns the role of the ActiveHandshake
+func (s *Session) handshakeRole() (role, error) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	h, err := s.getActiveHandshake()
+	if err != nil {
+		return initiator, err
+	}
+	return h.Role, nil
+}
+
+// wipeActiveHandshake wipes the ActiveHandshake from memory. The caller must hold handshakeMu.
+func (s *Session) wipeActiveHandshake() {
+	if s.activeHandshake != nil {
+		s.activeHandshake.wipe()
+		s.activeHandshake = nil
+	}
+}
+
+// handshakeKey returns the storage key for the persisted ActiveHandshake of the profile
+func (s *Session) handshakeKey() string {
+	return fmt.Sprintf("handshakes/%v/active", s.profileID())
 }
 
-// ShareHandshakePosition returns the values from negotiator.Share() from the ActiveHandshake
-func (s *Session) ShareHandshakePosition() (b []byte, err error) {
+// saveHandshake encrypts the ActiveHandshake with the profile key and writes it to storage
+func (s *Session) saveHandshake() error {
+	state, err := s.activeHandshake.State()
+	if err != nil {
+		return err
+	}
+	stateGob, err := encodeGob(state)
+	if err != nil {
+		return err
+	}
+	_, err = s.set(s.handshakeKey(), stateGob)
+	return err
+}
+
+// ResumeHandshake loads a handshake that was persisted by a previous session and makes it the ActiveHandshake.
+// It returns false if there was no handshake to resume. An expired handshake is securely deleted and an error
+// is returned.
+func (s *Session) ResumeHandshake() (bool, error) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if err := s.checkSessionLocked(); err != nil {
+		return false, err
+	}
+	h, ok, err := s.loadHandshake()
+	if err != nil || !ok {
+		return false, err
+	}
+	s.wipeActiveHandshake()
+	s.activeHandshake = h
+	return true, nil
+}
+
+// loadHandshake returns the persisted handshake of the profile and true, or false if there is none. An expired
+// handshake is securely deleted and ErrHandshakeExpired is returned.
+func (s *Session) loadHandshake() (*handshake, bool, error) {
+	encrypted, err := s.storage.Get(s.handshakeKey())
+	if err != nil || len(encrypted) == 0 {
+		return nil, false, err
+	}
+	stateGob, err := s.decrypt(encrypted)
+	if err != nil {
+		return nil, false, err
+	}
+	h, err := newHandshakeFromGob(stateGob)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.Expired() {
+		h.wipe()
+		if err := secureDelete(s.storage, s.handshakeKey()); err != nil {
+			return nil, false, err
+		}
+		return nil, false, ErrHandshakeExpired
+	}
+	return h, true, nil
+}
+
+// expireHandshake securely deletes the persisted handshake of the profile if it expired, so its entropy does not
+// stay in storage until the next ResumeHandshake
+func (s *Session) expireHandshake() error {
+	h, ok, err := s.loadHandshake()
+	if errors.Is(err, ErrHandshakeExpired) {
+		return nil
+	}
+	if err != nil || !ok {
+		return err
+	}
+	h.wipe()
+	return nil
+}
+
+// AbandonHandshake destroys the ActiveHandshake, wiping its entropy from memory and securely deleting
+// it from storage.
+func (s *Session) AbandonHandshake() error {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if err := s.checkSessionLocked(); err != nil {
+		return err
+	}
+	return s.abandonHandshake()
+}
+
+// abandonHandshake is AbandonHandshake for callers that hold handshakeMu
+func (s *Session) abandonHandshake() error {
+	s.wipeActiveHandshake()
+	return secureDelete(s.storage, s.handshakeKey())
+}
+
+// ShareHandshakePosition returns the json encoded PeerConfig of the ActiveHandshake position
+func (s *Session) ShareHandshakePosition() ([]byte, error) {
+	config, err := s.HandshakePosition()
+	if err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(config)
+}
+
+// HandshakePosition returns the PeerConfig of the ActiveHandshake position, to be shared with the other peers
+func (s *Session) HandshakePosition() (PeerConfig, error) {
 	// TODO: add encryption wrapper
-	return s.activeHandshake.Position.Share()
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	h, err := s.getActiveHandshake()
+	if err != nil {
+		return PeerConfig{}, err
+	}
+	config, err := h.Position.PeerConfig()
+	if err != nil {
+		return PeerConfig{}, err
+	}
+	return PeerConfig{config: config}, nil
 }
 
-// AddPeerToHandshake takes a json encoded peerConfig, attempts to unmarshal it and add it as a peer.
+// AddPeerToHandshake takes a json encoded PeerConfig, attempts to unmarshal it and add it with AddHandshakePeer.
 // It returns a bool and an error. The bool indicates if handshake.AllPeersReceived == true, in which case
 // the handshake can safely be conversted int a chat.
 func (s *Session) AddPeerToHandshake(body []byte) (bool, error) {
 	// TODO: add decryption wrapper
-	var config peerConfig
+	var config PeerConfig
 	if err := json.Unmarshal(body, &config); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrPeerRejected, err)
+	}
+	return s.AddHandshakePeer(config)
+}
+
+// AddHandshakePeer takes the PeerConfig of a peer and adds it to the ActiveHandshake. It returns true once
+// every peer was received and the handshake can be converted into a chat. A malformed or incompatible config
+// returns ErrPeerRejected.
+func (s *Session) AddHandshakePeer(config PeerConfig) (bool, error) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	h, err := s.getActiveHandshake()
+	if err != nil {
 		return false, err
 	}
-	if err := s.activeHandshake.AddPeer(config); err != nil {
+	if err := h.AddPeer(config.config); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrPeerRejected, err)
+	}
+	if err := s.saveHandshake(); err != nil {
 		return false, err
 	}
-	return s.activeHandshake.AllPeersReceived(), nil
+	return h.AllPeersReceived(), nil
 }
 
 // GetHandshakePeerTotal returns an int count of the number of peers to expect for a handshake
 func (s *Session) GetHandshakePeerTotal() int {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if s.checkSessionLocked() != nil || s.activeHandshake == nil {
+		return 0
+	}
 	return s.activeHandshake.GetPeerTotal()
 }
 
-// GetHandshakePeerConfig returns the json bytes encoded peerConfig based on peerID or and an error
+// GetHandshakePeerConfig returns the json encoded PeerConfig from HandshakePeerConfig
 func (s *Session) GetHandshakePeerConfig(sortNumber int) ([]byte, error) {
-	configs, err := s.activeHandshake.GetAllConfigs()
+	config, err := s.HandshakePeerConfig(sortNumber)
 	if err != nil {
 		return []byte{}, err
 	}
+	return json.Marshal(config)
+}
+
+// HandshakePeerConfig returns the PeerConfig with sortNumber, counting from 1, of the ActiveHandshake of an
+// initiator. The configs carry the final sort order and are shared with every peer.
+func (s *Session) HandshakePeerConfig(sortNumber int) (PeerConfig, error) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	h, err := s.getActiveHandshake()
+	if err != nil {
+		return PeerConfig{}, err
+	}
+	configs, err := h.GetAllConfigs()
+	if err != nil {
+		return PeerConfig{}, err
+	}
 	if sortNumber <= 0 {
-		return []byte{}, errors.New("sortNumber must be greater than 0")
+		return PeerConfig{}, errors.New("sortNumber must be greater than 0")
 	}
 	if sortNumber > len(configs) {
-		return []byte{}, errors.New("sortNumber is out of range")
+		return PeerConfig{}, errors.New("sortNumber is out of range")
 	}
-	return json.Marshal(configs[sortNumber-1])
+	// GetAllConfigs assigns the final sort order, so the state is saved again
+	if err := s.saveHandshake(); err != nil {
+		return PeerConfig{}, err
+	}
+	return PeerConfig{config: configs[sortNumber-1]}, nil
 }
 
 // set is a wrapper for combining the cipher and storage interfaces. Data in the value component is encrypted and then
 // stored in the storage engine.
 func (s *Session) set(key string, value []byte) (string, error) {
+	unlock, err := s.rlockKey()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 	encrypted, err := s.cipher.Encrypt(value, s.profile.Key)
 	if err != nil {
 		return "", err
@@ -194,13 +849,28 @@ func (s *Session) get(key string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
-	return s.cipher.Decrypt(encrypted, s.profile.Key)
+	return s.decrypt(encrypted)
+}
+
+// decrypt decrypts b with the profile key
+func (s *Session) decrypt(b []byte) ([]byte, error) {
+	unlock, err := s.rlockKey()
+	if err != nil {
+		return []byte{}, err
+	}
+	defer unlock()
+	return s.cipher.Decrypt(b, s.profile.Key)
 }
 
 // NewChat creates a new chat from the activeHandshake and returns a chat ID string and error.
 // If the chat is successfully created, it deletes the contents of the activeHandshake
 func (s *Session) NewChat() (string, error) {
-	peerTotal := s.GetHandshakePeerTotal()
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if _, err := s.getActiveHandshake(); err != nil {
+		return "", err
+	}
+	peerTotal := s.activeHandshake.GetPeerTotal()
 	negotiatorCount := len(s.activeHandshake.Negotiators)
 	if peerTotal < 2 {
 		return "", errors.New("not enough peers to start a chat")
@@ -209,21 +879,29 @@ func (s *Session) NewChat() (string, error) {
 		return "", fmt.Errorf("expected peer total to be %v but counted %v", peerTotal, negotiatorCount)
 	}
 	chatID := hex.EncodeToString(genRandBytes(chatIDLength))
+	// readers that list the chat while it is written wait until it is complete
+	defer s.lockChat(chatID)()
 	negotiators, err := s.activeHandshake.SortedNegotiatorList()
 	if err != nil {
 		return "", err
 	}
 	pepper := generatePepper(negotiators)
+	hc := s.activeHandshake.Config
 	config := chat{
 		ID:    chatID,
 		Peers: make(map[string]chatPeer),
+		Settings: chatSettings{
+			Cipher: hc.Cipher,
+			KDF:    hc.KDF,
+		},
 	}
-	basePath := fmt.Sprintf("chats/%v/%v", chatID, s.profile.ID)
+	basePath := fmt.Sprintf("chats/%v/%v", chatID, s.profileID())
 	for _, n := range negotiators {
 		cp := chatPeer{
-			ID:       hex.EncodeToString(genRandBytes(chatIDLength)),
-			Alias:    n.Alias,
-			Strategy: n.Strategy,
+			ID:          hex.EncodeToString(genRandBytes(chatIDLength)),
+			Alias:       n.Alias,
+			Strategy:    n.Strategy,
+			Fingerprint: peerFingerprint(pepper, n.Entropy),
 		}
 		config.Peers[cp.ID] = cp
 		if bytes.Equal(n.Entropy, s.activeHandshake.Position.Entropy) {
@@ -233,8 +911,9 @@ func (s *Session) NewChat() (string, error) {
 		var e [96]byte
 		copy(p[:], pepper)
 		copy(e[:], n.Entropy)
-		// TODO support cipherType inspection
-		lookups, err := genLookups(p, e, SecretBox, defaultLookupCount)
+		lookups, err := genLookupsWithKDF(p, e, hc.Cipher, defaultLookupCount, hc.KDF)
+		wipeBytes(p[:])
+		wipeBytes(e[:])
 		if err != nil {
 			return "", err
 		}
@@ -258,21 +937,113 @@ func (s *Session) NewChat() (string, error) {
 		return "", err
 	}
 
-	s.activeHandshake = &handshake{}
+	wipeBytes(pepper)
+	if err := s.abandonHandshake(); err != nil {
+		return "", err
+	}
+	if err := s.updateFetchIndex(); err != nil {
+		return "", err
+	}
 	return chatID, nil
 }
 
-// ListChats returns a json encoded list of chatIDs and an error
+// Chats returns the ChatInfo of every chat, with the number of unused keys of each active member
+func (s *Session) Chats() ([]ChatInfo, error) {
+	if err := s.checkSession(); err != nil {
+		return nil, err
+	}
+	chatIDs, err := s.chatIDs()
+	if err != nil {
+		return nil, err
+	}
+	summaries := []ChatInfo{}
+	for _, chatID := range chatIDs {
+		summary, err := s.chatInfo(chatID)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// ChatInfo returns the ChatInfo of chatID like Chats does, without loading the other chats
+func (s *Session) ChatInfo(chatID string) (ChatInfo, error) {
+	if err := s.checkSession(); err != nil {
+		return ChatInfo{}, err
+	}
+	return s.chatInfo(chatID)
+}
+
+// chatInfo returns the summary of chatID with the number of unused keys of each active member
+func (s *Session) chatInfo(chatID string) (ChatInfo, error) {
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	summary := c.Summary()
+	for i, m := range summary.Members {
+		if !m.Active || c.Left {
+			continue
+		}
+		l, err := s.getLookup(chatID, m.ID)
+		if err != nil {
+			return ChatInfo{}, err
+		}
+		summary.Members[i].Keys = len(l)
+	}
+	return summary, nil
+}
+
+// ListChats returns a json encoded list of chat summaries, with the members and membership events
+// of each chat, and an error
 func (s *Session) ListChats() ([]byte, error) {
-	list, err := s.storage.List("chats/")
+	chats, err := s.Chats()
 	if err != nil {
 		return []byte{}, err
 	}
-	return json.Marshal(uniqueChatIDsFromPaths(list, s.profile.ID))
+	return json.Marshal(chats)
+}
+
+// chatIDs returns the IDs of every chat of the profile
+func (s *Session) chatIDs() ([]string, error) {
+	list, err := s.storage.List("chats/")
+	if err != nil {
+		return nil, err
+	}
+	return uniqueChatIDsFromPaths(list, s.profileID()), nil
+}
+
+// lockChat locks chatID for a read-modify-write of its config, lookups and chat log and returns the function
+// that unlocks it
+func (s *Session) lockChat(chatID string) (unlock func()) {
+	s.chatLocksMu.Lock()
+	if s.chatLocks == nil {
+		s.chatLocks = make(map[string]*sync.Mutex)
+	}
+	m, ok := s.chatLocks[chatID]
+	if !ok {
+		m = &sync.Mutex{}
+		s.chatLocks[chatID] = m
+	}
+	s.chatLocksMu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// SetChatNickname takes a chatID and a nickname that is only stored locally, an empty nickname removes it
+func (s *Session) SetChatNickname(chatID, nickname string) error {
+	defer s.lockChat(chatID)()
+	c, err := s.getChat(chatID)
+	if err != nil {
+		return err
+	}
+	c.Nickname = nickname
+	return s.setChat(chatID, c)
 }
 
 func (s *Session) getChat(chatID string) (chat, error) {
-	key := fmt.Sprintf("chats/%v/%v/config", chatID, s.profile.ID)
+	key := fmt.Sprintf("chats/%v/%v/config", chatID, s.profileID())
 	chatGob, err := s.get(key)
 	if err != nil {
 		return chat{}, err
@@ -281,7 +1052,7 @@ func (s *Session) getChat(chatID string) (chat, error) {
 }
 
 func (s *Session) setChat(chatID string, c chat) error {
-	key := fmt.Sprintf("chats/%v/%v/config", chatID, s.profile.ID)
+	key := fmt.Sprintf("chats/%v/%v/config", chatID, s.profileID())
 	safeConfig, err := c.Config()
 	if err != nil {
 		return err
@@ -295,7 +1066,7 @@ func (s *Session) setChat(chatID string, c chat) error {
 }
 
 func (s *Session) getLookup(chatID, peerID string) (lookup, error) {
-	key := fmt.Sprintf("chats/%v/%v/lookups/%v", chatID, s.profile.ID, peerID)
+	key := fmt.Sprintf("chats/%v/%v/lookups/%v", chatID, s.profileID(), peerID)
 	lookupGob, err := s.get(key)
 	if err != nil {
 		return lookup{}, err
@@ -304,7 +1075,7 @@ func (s *Session) getLookup(chatID, peerID string) (lookup, error) {
 }
 
 func (s *Session) setLookup(chatID, peerID string, l lookup) error {
-	key := fmt.Sprintf("chats/%v/%v/lookups/%v", chatID, s.profile.ID, peerID)
+	key := fmt.Sprintf("chats/%v/%v/lookups/%v", chatID, s.profileID(), peerID)
 	lookupGob, err := encodeGob(l)
 	if err != nil {
 		return err
@@ -313,8 +1084,55 @@ func (s *Session) setLookup(chatID, peerID string, l lookup) error {
 	return err
 }
 
+// updateLookup passes the lookup of peerID to fn and saves the changes fn makes in a single transaction, so a
+// popped key is never used twice. Nothing is saved if fn returns an error.
+func (s *Session) updateLookup(chatID, peerID string, fn func(l lookup) error) error {
+	u, ok := s.storage.(updateStorage)
+	if !ok {
+		return errors.New("storage does not support atomic updates")
+	}
+	unlock, err := s.rlockKey()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// mu is held, so the profile is read directly rather than with profileID
+	key := fmt.Sprintf("chats/%v/%v/lookups/%v", chatID, s.profile.ID, peerID)
+	return u.update(key, func(encrypted []byte) ([]byte, error) {
+		lookupGob, err := s.cipher.Decrypt(encrypted, s.profile.Key)
+		if err != nil {
+			return nil, err
+		}
+		l, err := newLookupFromGob(lookupGob)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(l); err != nil {
+			return nil, err
+		}
+		if lookupGob, err = encodeGob(l); err != nil {
+			return nil, err
+		}
+		return s.cipher.Encrypt(lookupGob, s.profile.Key)
+	})
+}
+
+// Messages returns the sorted chat log of chatID without checking peers for new messages, followed by the
+// pending messages in the outbox
+func (s *Session) Messages(chatID string) ([]Message, error) {
+	cl, err := s.GetChatlog(chatID)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := s.pendingMessages(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return append(cl.Sorted(), pending...), nil
+}
+
 func (s *Session) GetChatlog(chatID string) (chatLog, error) {
-	key := fmt.Sprintf("chats/%v/%v/chatlog", chatID, s.profile.ID)
+	key := fmt.Sprintf("chats/%v/%v/chatlog", chatID, s.profileID())
 	chatLogGob, err := s.get(key)
 	if err != nil {
 		return chatLog{}, err
@@ -323,7 +1141,7 @@ func (s *Session) GetChatlog(chatID string) (chatLog, error) {
 }
 
 func (s *Session) setChatlog(chatID string, cl chatLog) error {
-	key := fmt.Sprintf("chats/%v/%v/chatlog", chatID, s.profile.ID)
+	key := fmt.Sprintf("chats/%v/%v/chatlog", chatID, s.profileID())
 	chatLogGob, err := encodeGob(cl)
 	if err != nil {
 		return err
@@ -332,298 +1150,341 @@ func (s *Session) setChatlog(chatID string, cl chatLog) error {
 	return err
 }
 
-func (s *Session) getRendezvousHash(chatID, peerID string) (hash string) {
-	c, err := s.getChat(chatID)
-	if err != nil {
-		return
-	}
-	l, err := s.getLookup(chatID, peerID)
+// Retrieve takes a chatID and initiates the retrieval process for all peers
+// it returns the sorted chat log and error. Use RetrieveReport to see the outcome for each peer.
+func (s *Session) Retrieve(chatID string) ([]Message, error) {
+	report, err := s.RetrieveReport(chatID)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return report.Messages, nil
+}
 
-	rBytes, err := c.Peers[peerID].Strategy.Rendezvous.Get("")
+// RetrieveMessages is the json encoded variant of Retrieve, it returns a json encoded chatLogList and error
+func (s *Session) RetrieveMessages(chatID string) ([]byte, error) {
+	messages, err := s.Retrieve(chatID)
 	if err != nil {
-		return // TODO: skip for now, there should be more logic here.
+		return []byte{}, err
 	}
+	return json.Marshal(messages)
+}
 
-	rHash := base64.StdEncoding.EncodeToString(rBytes[:lookupHashLength])
-	rKey := l.popKey(rHash)
-	if err := s.setLookup(chatID, peerID, l); err != nil {
-		return
-	}
-	hashBytes, err := c.Peers[peerID].Strategy.Cipher.Decrypt(rBytes[lookupHashLength:], rKey)
+// GetMyPeerID returns a string of the profile user's peerID for a specific chat, returns the peerID and an error
+func (s *Session) GetMyPeerID(chatID string) (string, error) {
+	c, err := s.getChat(chatID)
 	if err != nil {
-		return
+		return "", err
 	}
-	hash = string(hashBytes)
+	return c.PeerID, nil
+}
 
-	cl, err := s.GetChatlog(chatID)
+// Send takes a chatID and MessageData and submits the message to the message storage and
+// rendezvous point. Parent, Timestamp and TTL are set by Send. It returns the sorted chat log and error.
+// The message is queued in the outbox first, after any messages that could not be sent earlier, and the outbox is
+// flushed. If that fails, the returned error matches ErrMessagePending as well as the cause, the message stays in
+// the outbox without using up any keys and the returned chat log shows it as pending.
+func (s *Session) Send(chatID string, data MessageData) ([]Message, error) {
+	b, err := json.Marshal(data)
 	if err != nil {
-		return
-	}
-
-	if cl.HashInLog(hash) {
-		return ""
+		return nil, err
 	}
-	if err := s.setChat(chatID, c); err != nil {
-		return ""
+	if len(b) > maxMessageSize {
+		return nil, fmt.Errorf("messag sized exceeds max size of %v bytes", maxMessageSize)
 	}
-	return hash
-}
+	// control messages are only created by the session itself
+	data.Control = nil
 
-func (s *Session) retrieveMessage(chatID, hash, peerID string) (data chatData, err error) {
+	defer s.lockChat(chatID)()
 	c, err := s.getChat(chatID)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	l, err := s.getLookup(chatID, peerID)
-	if err != nil {
-		return
+	if c.ReadOnly() {
+		return nil, ErrChatReadOnly
 	}
 
-	b, err := c.Peers[peerID].Strategy.Storage.Get(hash)
-	if err != nil {
-		return
+	if err := s.queueMessage(chatID, data); err != nil {
+		s.emit(SendFailedEvent{ChatID: chatID, Err: err})
+		return nil, err
 	}
-	lookupHash := base64.StdEncoding.EncodeToString(b[:lookupHashLength])
-	key := l.popKey(lookupHash)
-	if len(key) == 0 {
-		return data, errors.New("no key")
+	if err := s.flushOutbox(chatID); err != nil {
+		err = pendingError{err: err}
+		s.emit(SendFailedEvent{ChatID: chatID, Err: err})
+		messages, mErr := s.Messages(chatID)
+		if mErr != nil {
+			return nil, err
+		}
+		return messages, err
 	}
-	err = s.setLookup(chatID, peerID, l)
-	if err != nil {
-		return
+	return s.Messages(chatID)
+}
+
+// SendMessage takes a chatID and json encoded MessageData and submits the message to the message
+// storage and rendezvous point. It returns a json encoded chatLogList and error
+func (s *Session) SendMessage(chatID string, b []byte) ([]byte, error) {
+	if len(b) > maxMessageSize {
+		return []byte{}, fmt.Errorf("messag sized exceeds max size of %v bytes", maxMessageSize)
 	}
-	d, err := c.Peers[peerID].Strategy.Cipher.Decrypt(b[lookupHashLength:], key)
-	if err != nil {
-		return
+
+	var data MessageData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return []byte{}, err
 	}
-	err = json.Unmarshal(d, &data)
+	messages, err := s.Send(chatID, data)
 	if err != nil {
-		return
+		return []byte{}, err
 	}
-	err = s.setChat(chatID, c)
-	return
+	return json.Marshal(messages)
 }
 
-func (s *Session) logChatData(chatID string, peerID string, hash string, data chatData) error {
-	cl, err := s.GetChatlog(chatID)
+// deleteAllWithPrefix takes a storage interface and a prefix string. It looks up all keys that
+// match the prefix and attempts to run the Delete method on all keys, returns a error or nil.
+func deleteAllWithPrefix(s storage, prefix string) error {
+	keys, err := s.List(prefix)
 	if err != nil {
 		return err
 	}
-
-	clEntry := chatLogEntry{
-		ID:     hash,
-		Sender: peerID,
-		Sent:   data.Timestamp,
-		TTL:    data.TTL,
-		Data:   data,
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if err := cl.AddEntry(clEntry); err != nil {
+// CreateProfile takes a password and adds a new, independent profile to storage. The profile is opened by passing
+// its password to NewSession, and its chats are kept under their own chats/*/<profileID> keys. The password must not
+// already open a profile.
+func (s *Session) CreateProfile(password string) error {
+	if err := s.checkSession(); err != nil {
+		return err
+	}
+	if err := s.checkPasswordUnused(password); err != nil {
 		return err
 	}
-	return s.setChatlog(chatID, cl)
+	return initProfile(generateRandomProfile(), password, s.cipher, s.storage)
 }
 
-func (s *Session) recursivelyLogParents(chatID string, peerID string, data chatData) error {
-	if data.Parent == "" {
-		return nil // if no parent set, return early
+// SetDuressPassword adds a duress profile that is opened with password. With DuressWipe, logging in with the
+// password securely deletes every profile and chat and opens a new empty profile. With DuressDecoy, the duress
+// profile is opened like any other, so it can be filled with harmless chats. The password must not already
+// open a profile.
+func (s *Session) SetDuressPassword(password string, action DuressAction) error {
+	if err := s.checkSession(); err != nil {
+		return err
 	}
-	cl, err := s.GetChatlog(chatID)
+	switch action {
+	case DuressWipe, DuressDecoy:
+	default:
+		return fmt.Errorf("unknown duress action: %v", action)
+	}
+	if err := s.checkPasswordUnused(password); err != nil {
+		return err
+	}
+	current, err := s.GetProfile()
 	if err != nil {
 		return err
 	}
-	if cl.HashInLog(data.Parent) {
-		return nil // if hash already in log, return early
+	p := generateRandomProfile()
+	p.Settings = current.Settings
+	p.Settings.Duress = action
+	return initProfile(p, password, s.cipher, s.storage)
+}
+
+// ChangePassword takes the current and a new password and re-encrypts the profile with a key derived from the
+// new password. Chats are encrypted with the profile key, which does not change, so they are not rewritten.
+func (s *Session) ChangePassword(oldPassword, newPassword string) error {
+	if err := s.checkSession(); err != nil {
+		return err
 	}
-	parentData, err := s.retrieveMessage(chatID, data.Parent, peerID)
+	stored, err := s.verifyPassword(oldPassword)
 	if err != nil {
-		if err.Error() == "no key" {
-			return nil
-		}
 		return err
 	}
-	if err := s.logChatData(chatID, peerID, data.Parent, parentData); err != nil {
+	defer wipeBytes(stored.Key)
+	if err := s.checkPasswordUnused(newPassword); err != nil {
 		return err
 	}
-	if parentData.Parent != "" {
-		return s.recursivelyLogParents(chatID, peerID, parentData)
+	p, err := s.GetProfile()
+	if err != nil {
+		return err
 	}
-	return nil
+	// the session profile of a duress login has its duress action cleared, the stored one keeps it
+	p.Settings = stored.Settings
+	return initProfile(p, newPassword, s.cipher, s.storage)
 }
 
-// RetrieveMessages takes a chatID and initiates the retrieval process for all peers
-// it returns a json encoded chatLogList and error
-func (s *Session) RetrieveMessages(chatID string) ([]byte, error) {
-	// this should query all peer endpoints and update the chatlog
-	// this step also runs ttl validation to clear out old messages
-	// it returns a json encoded chatLogList
-
-	c, err := s.getChat(chatID)
+// RotateProfileKey takes the profile password and replaces the profile key with a new random key. Every chat and
+// persisted handshake of the profile is re-encrypted with the new key and written together with the profile in a
+// single transaction. Handshakes, chat changes and fetch index updates wait until the rotation is done, so
+// nothing is written with the previous key. Session tokens of the profile are revoked.
+func (s *Session) RotateProfileKey(password string) error {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	if err := s.checkSessionLocked(); err != nil {
+		return err
+	}
+	stored, err := s.verifyPassword(password)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-
-	for peerID := range c.Peers {
-		if peerID == c.PeerID { // skip self
-			continue
-		}
-		hash := s.getRendezvousHash(chatID, peerID)
-		if hash == "" {
-			continue
-		}
-		data, err := s.retrieveMessage(chatID, hash, peerID)
-		if err != nil {
-			continue
-		}
-		if err := s.logChatData(chatID, peerID, hash, data); err != nil {
-			continue
-		}
-
-		if err := s.recursivelyLogParents(chatID, peerID, data); err != nil {
-			continue
-		}
-
+	defer wipeBytes(stored.Key)
+	batch, ok := s.storage.(batchStorage)
+	if !ok {
+		return errors.New("storage does not support atomic writes")
 	}
-	cl, err := s.GetChatlog(chatID)
+	chatIDs, err := s.chatIDs()
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-	return cl.SortedJSON()
-}
+	for _, chatID := range chatIDs {
+		defer s.lockChat(chatID)()
+	}
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
 
-// GetMyPeerID returns a string of the profile user's peerID for a specific chat, returns the peerID and an error
-func (s *Session) GetMyPeerID(chatID string) (string, error) {
-	c, err := s.getChat(chatID)
+	profileID := s.profileID()
+	var keys []string
+	chatKeys, err := s.storage.List("chats/")
 	if err != nil {
-		return "", err
+		return err
 	}
-	return c.PeerID, nil
-}
-
-// SendMessage takes a chatID and message bytes and submits the message to the message
-// storage and rendezvous point. It returns a json encoded chatLogList and error
-func (s *Session) SendMessage(chatID string, b []byte) ([]byte, error) {
-	if len(b) > maxMessageSize {
-		return []byte{}, fmt.Errorf("messag sized exceeds max size of %v bytes", maxMessageSize)
+	for _, key := range chatKeys {
+		if segments := strings.Split(key, "/"); len(segments) > 2 && segments[2] == profileID {
+			keys = append(keys, key)
+		}
 	}
-
-	c, err := s.getChat(chatID)
+	handshakeKeys, err := s.storage.List(fmt.Sprintf("handshakes/%v/", profileID))
 	if err != nil {
-		return []byte{}, err
-	}
-
-	var data chatData
-	if err := json.Unmarshal(b, &data); err != nil {
-		return []byte{}, err
+		return err
 	}
-	data.Parent = c.LastSent
-	data.Timestamp = time.Now().UnixNano()
-	data.TTL = c.TTL()
+	keys = append(keys, handshakeKeys...)
 
-	dataBytes, err := json.Marshal(data)
+	previousOwner, err := s.fetchOwner()
 	if err != nil {
-		return []byte{}, nil
+		return err
 	}
-
-	sender := c.Peers[c.PeerID]
-
-	l, err := s.getLookup(chatID, c.PeerID)
+	p, err := s.GetProfile()
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-	mStoreKey, mStoreValue := l.popRandom()
-	if err := s.setLookup(chatID, c.PeerID, l); err != nil {
-		return []byte{}, err
+	p.Settings = stored.Settings
+	p.Key = genRandBytes(profileKeyLength)
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		value, err := s.get(key)
+		if err != nil {
+			return err
+		}
+		if values[key], err = s.cipher.Encrypt(value, p.Key); err != nil {
+			return err
+		}
 	}
-
-	mStoreKeyBytes, err := base64.StdEncoding.DecodeString(mStoreKey)
+	id, err := p.IDBytes()
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-
-	cipherText, err := sender.Strategy.Cipher.Encrypt(dataBytes, mStoreValue)
+	encodedProfile, err := encodeGob(p)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-
-	var payload []byte
-	payload = append(payload, mStoreKeyBytes...)
-	payload = append(payload, cipherText...)
-	hash, err := sender.Strategy.Storage.Set("", payload)
-	if err != nil {
-		return []byte{}, err
+	if values[profileKeyPrefix+p.ID], err = s.cipher.Encrypt(encodedProfile, deriveKey([]byte(password), id)); err != nil {
+		return err
 	}
-	c.LastSent = hash
-
-	if err := s.setChat(chatID, c); err != nil {
-		return []byte{}, err
+	if err := batch.setBatch(values); err != nil {
+		return err
 	}
-
-	rStoreKey, rStoreValue := l.popRandom()
-	if err := s.setLookup(chatID, c.PeerID, l); err != nil {
-		return []byte{}, err
+	s.mu.Lock()
+	s.wipeKey()
+	s.profile.Key = p.Key
+	s.mu.Unlock()
+	// session tokens hold the previous key
+	if err := secureDeleteAllWithPrefix(s.storage, tokenKeyPrefix+p.ID+"/"); err != nil {
+		return err
 	}
+	return s.updateFetchIndexLocked(previousOwner)
+}
 
-	rStoreKeyBytes, err := base64.StdEncoding.DecodeString(rStoreKey)
+// verifyPassword returns the stored session profile, or an error if password does not open it. Attempts are
+// counted and delayed like logins with NewSession.
+func (s *Session) verifyPassword(password string) (Profile, error) {
+	p := Profile{ID: s.profileID()}
+	id, err := p.IDBytes()
 	if err != nil {
-		return []byte{}, err
+		return Profile{}, err
 	}
-
-	rCipherText, err := sender.Strategy.Cipher.Encrypt([]byte(hash), rStoreValue)
+	var stored Profile
+	g, err := attemptLogin(s.storage, func() (bool, error) {
+		key := deriveKey([]byte(password), id)
+		var err error
+		stored, err = getProfileFromEncryptedStorage(profileKeyPrefix+p.ID, key, s.cipher, s.storage)
+		return err == nil, nil
+	})
 	if err != nil {
-		return []byte{}, err
+		return Profile{}, err
 	}
+	s.mu.Lock()
+	s.globalConfig = g
+	s.mu.Unlock()
+	return stored, nil
+}
 
-	var rPayload []byte
-	rPayload = append(rPayload, rStoreKeyBytes...)
-	rPayload = append(rPayload, rCipherText...)
-
-	if _, err := sender.Strategy.Rendezvous.Set("", rPayload); err != nil {
-		return []byte{}, err
+// checkPasswordUnused returns an error if password already opens a profile in storage
+func (s *Session) checkPasswordUnused(password string) error {
+	profilePaths, err := s.storage.List(profileKeyPrefix)
+	if err != nil {
+		return err
 	}
-
-	cl, err := s.GetChatlog(chatID)
+	_, exists, err := findProfile(password, profilePaths, s.cipher, s.storage)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-
-	clEntry := chatLogEntry{
-		ID:     hash,
-		Sender: c.PeerID,
-		Sent:   data.Timestamp,
-		TTL:    data.TTL,
-		Data:   data,
+	if exists {
+		return errors.New("password is already in use")
 	}
+	return nil
+}
 
-	if err := cl.AddEntry(clEntry); err != nil {
-		return []byte{}, err
-	}
-	if err := s.setChatlog(chatID, cl); err != nil {
-		return []byte{}, err
+// wipeProfiles securely deletes every profile, chat, persisted handshake and session token in storage
+func wipeProfiles(s storage) error {
+	for _, prefix := range []string{profileKeyPrefix, "chats/", "handshakes/", tokenKeyPrefix, fetchIndexKey} {
+		if err := secureDeleteAllWithPrefix(s, prefix); err != nil {
+			return err
+		}
 	}
-
-	return cl.SortedJSON()
+	return nil
 }
 
-// deleteAllWithPrefix takes a storage interface and a prefix string. It looks up all keys that
-// match the prefix and attempts to run the Delete method on all keys, returns a error or nil.
-func deleteAllWithPrefix(s storage, prefix string) error {
+// secureDeleteAllWithPrefix runs secureDelete on all keys that match the prefix, returns an error or nil
+func secureDeleteAllWithPrefix(s storage, prefix string) error {
 	keys, err := s.List(prefix)
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
-		if err := s.Delete(key); err != nil {
+		if err := secureDelete(s, key); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// secureDelete overwrites the value stored at key with random bytes before deleting it. Depending on
+// the storage engine, this is a best effort and previous copies of the value may still be present.
+func secureDelete(s storage, key string) error {
+	value, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		return nil
+	}
+	if _, err := s.Set(key, genRandBytes(len(value))); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
 // gobBytes takes an empty interface and returns a byte slice and error
 func encodeGob(x interface{}) ([]byte, error) {
 	var buffer bytes.Buffer
@@ -1,17 +1,47 @@
 package handshake
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func ensureCleanDB() {
 	os.Remove("./handshake.boltdb")
 }
 
+// useTestDataDir points DefaultDataDir at a temporary directory for the duration of the test and returns the
+// path of the default storage file in it
+func useTestDataDir(t *testing.T) string {
+	xdg, ok := os.LookupEnv("XDG_DATA_HOME")
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("XDG_DATA_HOME", xdg)
+		} else {
+			os.Unsetenv("XDG_DATA_HOME")
+		}
+	})
+	os.Setenv("XDG_DATA_HOME", t.TempDir())
+	dataDir, err := DefaultDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSessionOptions(dataDir).StorageFilePath
+}
+
 func TestNewDefaultSession(t *testing.T) {
-	ensureCleanDB()
-	defer ensureCleanDB()
+	storagePath := useTestDataDir(t)
+	if exists, err := ProfilesExist(); err != nil || exists {
+		t.Fatalf("expected no profiles in a new data dir, got %v", err)
+	}
 	password := "hello,world"
 	if err := NewGenesisProfile(password); err != nil {
 		t.Fatal(err)
@@ -28,4 +58,889 @@ func TestNewDefaultSession(t *testing.T) {
 	if s2 != nil {
 		s2.Close()
 	}
+	if _, err := os.Stat(storagePath); err != nil {
+		t.Errorf("expected the default storage in the data dir: %v", err)
+	}
+}
+
+// newTestSession creates a profile with password in a fresh bolt database at path and returns a Session for it
+func newTestSession(t *testing.T, path, password string) *Session {
+	os.Remove(path)
+	storage, err := newStorage(StorageOptions{Engine: BoltEngine, FilePath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initProfile(generateRandomProfile(), password, newTimeSeriesSBCipher(), storage); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	s, err := NewSession(password, SessionOptions{StorageEngine: BoltEngine, StorageFilePath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestResumeHandshake(t *testing.T) {
+	storagePath := "resume-handshake.boltdb"
+	defer os.Remove(storagePath)
+	password := "resume_me"
+
+	s := newTestSession(t, storagePath, password)
+	if err := s.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	share, err := newHandshakePeerWithDefaults().Position.Share()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddPeerToHandshake(share); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+	s, err = NewSession(password, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	resumed, err := s.ResumeHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatal("expected handshake to be resumed")
+	}
+	if total := s.GetHandshakePeerTotal(); total != 2 {
+		t.Errorf("expected 2 peers after resume, got %v", total)
+	}
+	if err := s.AbandonHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, _ := s.ResumeHandshake(); resumed {
+		t.Error("expected abandoned handshake to be deleted")
+	}
+}
+
+func TestExpiredHandshakeDeletedAtOpen(t *testing.T) {
+	storagePath := "expired-handshake.boltdb"
+	defer os.Remove(storagePath)
+	password := "expire_me"
+
+	s := newTestSession(t, storagePath, password)
+	h := newHandshakeInitiatorWithDefaults()
+	h.Expires = time.Now().Unix() - 1
+	s.activeHandshake = h
+	if err := s.saveHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	key := s.handshakeKey()
+	s.Close()
+
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+	s, err := NewSession(password, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if stored, err := s.storage.Get(key); err != nil || len(stored) != 0 {
+		t.Errorf("expected the expired handshake to be deleted when the session opened, got %v bytes, %v", len(stored), err)
+	}
+}
+
+func TestSessionTTL(t *testing.T) {
+	storagePath := "session-ttl.boltdb"
+	defer os.Remove(storagePath)
+	password := "lock_me_up"
+
+	s := newTestSession(t, storagePath, password)
+	defer s.Close()
+	if err := s.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Touch(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.startTime -= s.sessionTTL() + 1
+	if _, err := s.ListChats(); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if len(s.profile.Key) != 0 || s.activeHandshake != nil {
+		t.Error("expected the profile key and handshake to be wiped")
+	}
+	if err := s.Touch(); err != ErrSessionExpired {
+		t.Errorf("expected Touch to fail on an expired session, got %v", err)
+	}
+	if _, err := s.ShareHandshakePosition(); err != ErrSessionExpired {
+		t.Errorf("expected ErrSessionExpired, got %v", err)
+	}
+
+	if err := s.Unlock("wrong password"); err == nil {
+		t.Error("expected an invalid password to fail")
+	}
+	if err := s.Unlock(password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListChats(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := s.ResumeHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Error("expected the persisted handshake to survive the lock")
+	}
+}
+
+func TestFailedLoginLockout(t *testing.T) {
+	storagePath := "failed-login.boltdb"
+	defer os.Remove(storagePath)
+	password := "correct_horse"
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+	defer func(base time.Duration) { loginDelayBase = base }(loginDelayBase)
+	loginDelayBase = time.Millisecond
+
+	s := newTestSession(t, storagePath, password)
+	if err := s.SetLockoutPolicy(3, LockoutTimeout, 60); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := NewSession("wrong", opts); !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("expected invalid password, got %v", err)
+		}
+	}
+	if _, err := NewSession("wrong", opts); !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected a lockout, got %v", err)
+	}
+	if _, err := NewSession(password, opts); err == nil {
+		t.Fatal("expected the correct password to be refused during the lockout")
+	}
+
+	storage, err := newStorage(StorageOptions{Engine: BoltEngine, FilePath: storagePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = updateStoredGlobalConfig(storage, func(g *globalConfig) {
+		g.LockedUntil = time.Now().Unix() - 1
+		g.FailedLoginAttempts = 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	s, err = NewSession(password, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.globalConfig.FailedLoginAttempts != 0 {
+		t.Errorf("expected the counter to reset, got %v", s.globalConfig.FailedLoginAttempts)
+	}
+	if err := s.SetLockoutPolicy(2, LockoutWipe, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := NewSession("wrong", opts); !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("expected invalid password, got %v", err)
+		}
+	}
+	if _, err := NewSession(password, opts); !errors.Is(err, ErrNoProfile) {
+		t.Errorf("expected profiles to be wiped, got %v", err)
+	}
+}
+
+func TestUnlockLockout(t *testing.T) {
+	storagePath := "unlock-lockout.boltdb"
+	defer os.Remove(storagePath)
+	password := "correct_horse"
+	defer func(base time.Duration) { loginDelayBase = base }(loginDelayBase)
+	loginDelayBase = time.Millisecond
+
+	s := newTestSession(t, storagePath, password)
+	defer s.Close()
+	if err := s.SetLockoutPolicy(3, LockoutTimeout, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassword("wrong", "new_password"); !errors.Is(err, ErrInvalidPassword) {
+		t.Fatalf("expected invalid password, got %v", err)
+	}
+	s.Lock()
+	if err := s.Unlock("wrong"); !errors.Is(err, ErrInvalidPassword) {
+		t.Fatalf("expected invalid password, got %v", err)
+	}
+	if err := s.Unlock("wrong"); !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected the third failure to lock logins, got %v", err)
+	}
+	if err := s.Unlock(password); !errors.Is(err, ErrLoginLocked) {
+		t.Errorf("expected the correct password to be refused during the lockout, got %v", err)
+	}
+	if len(s.profile.Key) != 0 {
+		t.Error("expected the session to stay locked")
+	}
+}
+
+func TestConcurrentFailedLogins(t *testing.T) {
+	storagePath := "concurrent-logins.boltdb"
+	defer os.Remove(storagePath)
+	s := newTestSession(t, storagePath, "password")
+	defer s.Close()
+	if err := s.SetLockoutPolicy(100, LockoutTimeout, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recordFailedLogin(s.storage)
+		}()
+	}
+	wg.Wait()
+	g, err := getGlobalConfig(s.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.FailedLoginAttempts != 10 {
+		t.Errorf("expected every failed login to be counted, got %v", g.FailedLoginAttempts)
+	}
+}
+
+func TestUnlockDuress(t *testing.T) {
+	storagePath := "unlock-duress.boltdb"
+	defer os.Remove(storagePath)
+	password := "everyday_password"
+
+	s := newTestSession(t, storagePath, password)
+	defer s.Close()
+	if err := s.SetDuressPassword("decoy_password", DuressDecoy); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDuressPassword("wipe_password", DuressWipe); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.set(fmt.Sprintf("chats/abc/%v/config", s.profile.ID), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	profileID := s.profile.ID
+
+	s.Lock()
+	if err := s.Unlock("decoy_password"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := s.GetProfile(); err != nil || p.ID == profileID || p.Settings.Duress != "" || len(p.Key) == 0 {
+		t.Error("expected the decoy profile to be opened like a normal one")
+	}
+
+	s.Lock()
+	if err := s.Unlock("wipe_password"); err != nil {
+		t.Fatal(err)
+	}
+	chats, err := s.storage.List("chats/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := s.storage.List(profileKeyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 0 || len(profiles) != 1 || profiles[0] != profileKeyPrefix+s.profileID() {
+		t.Errorf("expected only a new empty profile, found %v and %v", profiles, chats)
+	}
+}
+
+func TestDuressPassword(t *testing.T) {
+	storagePath := "duress.boltdb"
+	defer os.Remove(storagePath)
+	password := "everyday_password"
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+
+	s := newTestSession(t, storagePath, password)
+	if err := s.SetDuressPassword(password, DuressWipe); err == nil {
+		t.Error("expected the profile password to be refused as a duress password")
+	}
+	if err := s.SetDuressPassword("decoy_password", DuressDecoy); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDuressPassword("wipe_password", DuressWipe); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.set(fmt.Sprintf("chats/abc/%v/config", s.profile.ID), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	profileID := s.profile.ID
+	s.Close()
+
+	decoy, err := NewSession("decoy_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoy.profile.ID == profileID || decoy.profile.Settings.Duress != "" {
+		t.Error("expected a separate decoy profile that looks like a normal one")
+	}
+	decoy.Close()
+
+	wiped, err := NewSession("wipe_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := wiped.storage.List("chats/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := wiped.storage.List(profileKeyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 0 || len(profiles) != 1 || profiles[0] != profileKeyPrefix+wiped.profile.ID {
+		t.Errorf("expected only a new empty profile, found %v and %v", profiles, chats)
+	}
+	wiped.Close()
+
+	if _, err := NewSession(password, opts); err == nil {
+		t.Error("expected the original profile to be gone")
+	}
+	again, err := NewSession("wipe_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+}
+
+func TestChangePasswordInDuressSession(t *testing.T) {
+	storagePath := "duress-change-password.boltdb"
+	defer os.Remove(storagePath)
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+
+	s := newTestSession(t, storagePath, "everyday_password")
+	if err := s.SetDuressPassword("decoy_password", DuressDecoy); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	decoy, err := NewSession("decoy_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	if err := decoy.ChangePassword("decoy_password", "new_decoy_password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoy.RotateProfileKey("new_decoy_password"); err != nil {
+		t.Fatal(err)
+	}
+	profilePaths, err := decoy.storage.List(profileKeyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, ok, err := findProfile("new_decoy_password", profilePaths, decoy.cipher, decoy.storage)
+	if err != nil || !ok {
+		t.Fatalf("expected the new password to open the decoy profile, got %v", err)
+	}
+	if stored.Settings.Duress != DuressDecoy {
+		t.Errorf("expected the decoy profile to keep its duress action, got %q", stored.Settings.Duress)
+	}
+	if decoy.profile.Settings.Duress != "" {
+		t.Error("expected the decoy session to still look like a normal one")
+	}
+}
+
+func TestChangePasswordAndRotateProfileKey(t *testing.T) {
+	storagePath := "change-password.boltdb"
+	defer os.Remove(storagePath)
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+
+	s := newTestSession(t, storagePath, "first_password")
+	if err := s.NewInitiatorWithDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	chatKey := fmt.Sprintf("chats/abc/%v/config", s.profile.ID)
+	if _, err := s.set(chatKey, []byte("chat config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassword("wrong", "second_password"); err == nil {
+		t.Error("expected an invalid old password to fail")
+	}
+	if err := s.ChangePassword("first_password", "second_password"); err != nil {
+		t.Fatal(err)
+	}
+	oldKey := append([]byte{}, s.profile.Key...)
+	if err := s.RotateProfileKey("second_password"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := NewSession("first_password", opts); err == nil {
+		t.Error("expected the old password to be refused")
+	}
+	s, err := NewSession("second_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if bytes.Equal(s.profile.Key, oldKey) {
+		t.Error("expected a new profile key")
+	}
+	value, err := s.get(chatKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "chat config" {
+		t.Errorf("unexpected chat value %q", value)
+	}
+	encrypted, err := s.storage.Get(chatKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.cipher.Decrypt(encrypted, oldKey); err == nil {
+		t.Error("expected the chat to be re-encrypted")
+	}
+	if resumed, err := s.ResumeHandshake(); err != nil || !resumed {
+		t.Errorf("expected the handshake to be re-encrypted, got %v %v", resumed, err)
+	}
+}
+
+func TestExpiredKeyIsWiped(t *testing.T) {
+	storagePath := "expired-key.boltdb"
+	defer os.Remove(storagePath)
+
+	s := newTestSession(t, storagePath, "password")
+	defer s.Close()
+	key := fmt.Sprintf("chats/abc/%v/config", s.profile.ID)
+	if _, err := s.set(key, []byte("chat config")); err != nil {
+		t.Fatal(err)
+	}
+	s.startTime -= s.sessionTTL() + 1
+	if _, err := s.get(key); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if len(s.profile.Key) != 0 {
+		t.Error("expected the profile key to be wiped once the session expired")
+	}
+}
+
+func TestGetProfileExpired(t *testing.T) {
+	storagePath := "get-profile-expired.boltdb"
+	defer os.Remove(storagePath)
+
+	s := newTestSession(t, storagePath, "password")
+	defer s.Close()
+	if p, err := s.GetProfile(); err != nil || len(p.Key) == 0 {
+		t.Fatalf("expected the profile key of an active session, got %v", err)
+	}
+	s.startTime -= s.sessionTTL() + 1
+	if p, err := s.GetProfile(); err != ErrSessionExpired || len(p.Key) != 0 {
+		t.Fatalf("expected ErrSessionExpired without a key, got %v", err)
+	}
+	if len(s.profile.Key) != 0 {
+		t.Error("expected the profile key to be wiped once the session expired")
+	}
+}
+
+func TestReleaseStorage(t *testing.T) {
+	storagePath := "release-storage.boltdb"
+	defer os.Remove(storagePath)
+	defer func(d time.Duration) { storageOpenTimeout = d }(storageOpenTimeout)
+	storageOpenTimeout = 100 * time.Millisecond
+	opts := StorageOptions{Engine: BoltEngine, FilePath: storagePath}
+
+	s := newTestSession(t, storagePath, "password")
+	defer s.Close()
+	key := fmt.Sprintf("chats/abc/%v/config", s.profile.ID)
+	if _, err := s.set(key, []byte("chat config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStorage(opts); !errors.Is(err, ErrStorageInUse) {
+		t.Fatalf("expected ErrStorageInUse while the session holds the file, got %v", err)
+	}
+
+	if err := s.ReleaseStorage(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := newStorage(opts)
+	if err != nil {
+		t.Fatalf("expected the released file to open, got %v", err)
+	}
+	if _, err := s.get(key); !errors.Is(err, ErrStorageInUse) {
+		t.Errorf("expected ErrStorageInUse while another process holds the file, got %v", err)
+	}
+	other.Close()
+	if value, err := s.get(key); err != nil || string(value) != "chat config" {
+		t.Errorf("expected the session to open the file again, got %q, %v", value, err)
+	}
+}
+
+func TestUnlockConcurrently(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-unlock-concurrently.boltdb", "bob-unlock-concurrently.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	aliceChatID, _ := newTestChat(t, n, alice, bob)
+
+	const count = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*count)
+	for i := 0; i < count; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			errs <- alice.Unlock("alice_password")
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := alice.Messages(aliceChatID)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := alice.ChatInfo(aliceChatID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRotateProfileKeyConcurrently(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-rotate.boltdb", "bob-rotate.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	newTestChat(t, n, alice, bob)
+	if err := alice.SetFetchIndex(true); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*count)
+	for i := 0; i < count; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			errs <- alice.RotateProfileKey("alice_password")
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- alice.NewInitiatorWithDefaults()
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- alice.updateFetchIndex()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := alice.get(alice.handshakeKey()); err != nil {
+		t.Errorf("expected the handshake to be encrypted with the current key, got %v", err)
+	}
+	owner, err := alice.fetchOwner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := getFetchIndex(alice.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Owner != owner {
+		t.Errorf("expected one fetch entry of the current key, got %+v", entries)
+	}
+}
+
+func TestCreateProfile(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"work-profile.boltdb", "peer-profile.boltdb"}
+	defer removeTestDBs(paths...)
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: paths[0]}
+
+	work := newTestSession(t, paths[0], "work_password")
+	if err := work.CreateProfile("work_password"); err == nil {
+		t.Error("expected a password in use to be refused")
+	}
+	if err := work.CreateProfile("personal_password"); err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestSession(t, paths[1], "peer_password")
+	defer peer.Close()
+	newTestChat(t, n, work, peer)
+	work.Close()
+
+	personal, err := NewSession("personal_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := personal.ListChats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(list) != "[]" {
+		t.Errorf("expected no chats in the personal profile, got %v", string(list))
+	}
+	personal.Close()
+
+	work, err = NewSession("work_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer work.Close()
+	var summaries []ChatInfo
+	if list, err = work.ListChats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(list, &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 {
+		t.Errorf("expected one chat in the work profile, got %v", string(list))
+	}
+}
+
+func TestSessionOptionsDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handshake-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := NewSessionOptions(filepath.Join(dir, "nested"))
+
+	exists, err := ProfilesExistWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected no profiles in a new data dir")
+	}
+	if err := NewGenesisProfileWithOptions("data_dir_password", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenesisProfileWithOptions("data_dir_password", opts); err == nil {
+		t.Error("expected a second genesis profile to be refused")
+	}
+	if exists, err = ProfilesExistWithOptions(opts); err != nil || !exists {
+		t.Fatalf("expected the profile to exist, got %v %v", exists, err)
+	}
+	s, err := NewSession("data_dir_password", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := os.Stat(opts.StorageFilePath); err != nil {
+		t.Errorf("expected storage in the data dir: %v", err)
+	}
+}
+
+func TestListChats(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-list.boltdb", "bob-list.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, _ := newTestChat(t, n, alice, bob)
+	if err := alice.SetChatNickname(aliceChatID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SendMessage(aliceChatID, []byte(`{"message": "hi"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := alice.ListChats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []ChatInfo
+	if err := json.Unmarshal(list, &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].ID != aliceChatID || summaries[0].Nickname != "bob" {
+		t.Fatalf("unexpected chat list %v", string(list))
+	}
+	keys := make(map[bool]int)
+	for _, m := range summaries[0].Members {
+		keys[m.ID == summaries[0].PeerID] = m.Keys
+	}
+	// a message and a rendezvous key are used for each send
+	if keys[false] == 0 || keys[true] != keys[false]-2 {
+		t.Errorf("unexpected key counts %v", keys)
+	}
+}
+
+func TestSendAndRetrieve(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-typed.boltdb", "bob-typed.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	sent, err := alice.Send(aliceChatID, MessageData{Message: `"quoted" hello`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].Sender == "" || sent[0].Data.Message != `"quoted" hello` {
+		t.Fatalf("unexpected chat log %+v", sent)
+	}
+
+	received, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].ID != sent[0].ID {
+		t.Fatalf("expected bob to receive %+v, got %+v", sent, received)
+	}
+	messages, err := bob.Messages(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, received) {
+		t.Errorf("expected Messages to return %+v, got %+v", received, messages)
+	}
+
+	chats, err := bob.Chats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].ID != bobChatID || len(chats[0].Members) != 2 {
+		t.Errorf("unexpected chats %+v", chats)
+	}
+	info, err := bob.ChatInfo(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, chats[0]) {
+		t.Errorf("expected ChatInfo to return %+v, got %+v", chats[0], info)
+	}
+}
+
+func TestLookupExhausted(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-exhausted.boltdb", "bob-exhausted.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, _ := newTestChat(t, n, alice, bob)
+	c, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range l {
+		if len(l) <= 1 {
+			break
+		}
+		delete(l, k)
+	}
+	if err := alice.setLookup(aliceChatID, c.PeerID, l); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Send(aliceChatID, MessageData{Message: "hi"}); !errors.Is(err, ErrLookupExhausted) {
+		t.Errorf("expected ErrLookupExhausted, got %v", err)
+	}
+}
+
+func TestConcurrentSendAndRetrieve(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-concurrent.boltdb", "bob-concurrent.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	c, err := alice.getChat(aliceChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*count)
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := alice.Send(aliceChatID, MessageData{Message: fmt.Sprintf("message %v", i)})
+			errs <- err
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := alice.Retrieve(aliceChatID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := alice.getLookup(aliceChatID, c.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a message and a rendezvous key are used for each send
+	if len(before)-len(after) != 2*count {
+		t.Errorf("expected %v keys to be used, got %v", 2*count, len(before)-len(after))
+	}
+	messages, err := bob.Retrieve(bobChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != count {
+		t.Errorf("expected bob to receive %v messages, got %v", count, len(messages))
+	}
 }
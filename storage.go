@@ -10,7 +10,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nomasters/hashmap"
@@ -43,6 +46,9 @@ const (
 	defaultRendezvousURL = "https://prototype.hashmap.sh"
 )
 
+// storageOpenTimeout is how long opening the bolt file waits for another process to release it
+var storageOpenTimeout = 30 * time.Second
+
 type signatureType int
 
 const (
@@ -81,6 +87,21 @@ type storage interface {
 	share() (peerStorage, error)
 }
 
+// batchStorage is implemented by storage engines that can set several values atomically
+type batchStorage interface {
+	setBatch(values map[string][]byte) error
+}
+
+// releaseStorage is implemented by storage engines that lock a file while open and can release it while idle
+type releaseStorage interface {
+	release() error
+}
+
+// updateStorage is implemented by storage engines that can read and replace a value in a single transaction
+type updateStorage interface {
+	update(key string, fn func(value []byte) ([]byte, error)) error
+}
+
 func newDefaultRendezvous() *hashmapStorage {
 	privateKey := hashmap.GenerateKey()
 	publicKey := privateKey[32:]
@@ -169,7 +190,10 @@ func newBoltStorage(opts StorageOptions) (boltStorage, error) {
 	if opts.FilePath != "" {
 		fp = opts.FilePath
 	}
-	db, err := bolt.Open(fp, 0666, nil)
+	if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+		return boltStorage{}, err
+	}
+	db, err := openBolt(fp)
 	if err != nil {
 		return boltStorage{}, err
 	}
@@ -196,14 +220,81 @@ func newBoltStorage(opts StorageOptions) (boltStorage, error) {
 		return boltStorage{}, err
 	}
 
-	return boltStorage{db: db, tlb: tlb}, nil
+	return boltStorage{file: &boltFile{path: fp, db: db}, tlb: tlb}, nil
+}
+
+// openBolt opens the bolt file at path. Bolt holds an exclusive lock on the file while it is open, so it waits up
+// to storageOpenTimeout for another process to release it and then returns ErrStorageInUse.
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: storageOpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %v", ErrStorageInUse, path)
+	}
+	return db, err
 }
 
 // BoltStorage is a struct that conforms to the Storage interface for using
-// BoltDB. DB is a reference to a boltDB instance and TLB stands for "top level bucket"
+// BoltDB. File is the boltDB instance shared by copies of the struct and TLB stands for "top level bucket"
 type boltStorage struct {
-	db  *bolt.DB
-	tlb string
+	file *boltFile
+	tlb  string
+}
+
+// boltFile holds the bolt database of a boltStorage. The database is nil while the file is released, and the
+// next transaction opens it again.
+type boltFile struct {
+	sync.RWMutex
+	path   string
+	db     *bolt.DB
+	closed bool
+}
+
+// use runs fn with the open database, opening the file again if it was released. The file is not released
+// while fn runs.
+func (f *boltFile) use(fn func(db *bolt.DB) error) error {
+	f.RLock()
+	for f.db == nil {
+		f.RUnlock()
+		f.Lock()
+		if f.closed {
+			f.Unlock()
+			return bolt.ErrDatabaseNotOpen
+		}
+		if f.db == nil {
+			db, err := openBolt(f.path)
+			if err != nil {
+				f.Unlock()
+				return err
+			}
+			f.db = db
+		}
+		f.Unlock()
+		f.RLock()
+	}
+	defer f.RUnlock()
+	return fn(f.db)
+}
+
+// release closes the file, so other processes can open it, until the next transaction opens it again
+func (s boltStorage) release() error {
+	s.file.Lock()
+	defer s.file.Unlock()
+	if s.file.db == nil {
+		return nil
+	}
+	err := s.file.db.Close()
+	s.file.db = nil
+	return err
+}
+
+// viewTx runs fn in a read-only transaction
+func (s boltStorage) viewTx(fn func(tx *bolt.Tx) error) error {
+	return s.file.use(func(db *bolt.DB) error { return db.View(fn) })
+}
+
+// updateTx runs fn in a read-write transaction
+func (s boltStorage) updateTx(fn func(tx *bolt.Tx) error) error {
+	return s.file.use(func(db *bolt.DB) error { return db.Update(fn) })
 }
 
 // Get takes a key string and returns a byte slice or error from a BoltStorage struct. Get
@@ -211,9 +302,12 @@ type boltStorage struct {
 // is returned if the key invalid in formatting, it is too long, or there is an underlying issue
 // with boltDB
 func (s boltStorage) Get(key string) (value []byte, err error) {
-	err = s.db.View(func(tx *bolt.Tx) error {
+	err = s.viewTx(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(s.tlb))
-		value = b.Get([]byte(key))
+		// the value is only valid during the transaction, and the file may be released after it
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
 		return nil
 	})
 	return value, err
@@ -223,7 +317,7 @@ func (s boltStorage) Get(key string) (value []byte, err error) {
 // Set treats both create and updates the same. Errors are returned if the key has invalid syntax
 // and if key or value are too long.
 func (s boltStorage) Set(key string, value []byte) (string, error) {
-	return key, s.db.Update(func(tx *bolt.Tx) error {
+	return key, s.updateTx(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(s.tlb))
 		return b.Put([]byte(key), value)
 	})
@@ -231,7 +325,7 @@ func (s boltStorage) Set(key string, value []byte) (string, error) {
 
 // Delete takes a key string and deletes item, if it exists in storage, returns an error from a BoltStorage struct.
 func (s boltStorage) Delete(key string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.updateTx(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(s.tlb))
 		return b.Delete([]byte(key))
 	})
@@ -240,7 +334,7 @@ func (s boltStorage) Delete(key string) error {
 // List takes a path and returns a slice of key paths formatted as strings or an error.
 func (s boltStorage) List(path string) (keys []string, err error) {
 	p := []byte(path)
-	err = s.db.View(func(tx *bolt.Tx) error {
+	err = s.viewTx(func(tx *bolt.Tx) error {
 		c := tx.Bucket([]byte(s.tlb)).Cursor()
 		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
 			keys = append(keys, string(k))
@@ -250,6 +344,33 @@ func (s boltStorage) List(path string) (keys []string, err error) {
 	return keys, err
 }
 
+// setBatch takes a map of keys and values and sets all of them in a single bolt transaction, so either every
+// value is written or none are.
+func (s boltStorage) setBatch(values map[string][]byte) error {
+	return s.updateTx(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.tlb))
+		for k, v := range values {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// update takes a key and passes a copy of its value to fn, then replaces the value with the result of fn in
+// the same bolt transaction. Nothing is written if fn returns an error.
+func (s boltStorage) update(key string, fn func(value []byte) ([]byte, error)) error {
+	return s.updateTx(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.tlb))
+		value, err := fn(append([]byte{}, b.Get([]byte(key))...))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
 // share is not configured on BoltStorage, since it is private storage.
 // Therefore it returns an empty struct.
 func (s boltStorage) share() (peerStorage, error) {
@@ -264,7 +385,15 @@ func (s boltStorage) export() (storageConfig, error) {
 
 // Close is used to close the Bolt DB engine and returns an error
 func (s boltStorage) Close() error {
-	return s.db.Close()
+	s.file.Lock()
+	defer s.file.Unlock()
+	s.file.closed = true
+	if s.file.db == nil {
+		return nil
+	}
+	err := s.file.db.Close()
+	s.file.db = nil
+	return err
 }
 
 // HashmapStorage interacts with a hashmap server and
@@ -302,7 +431,7 @@ func (s *hashmapStorage) updateLatest(timeStamp int64) error {
 	// check for potential replay attack, which latest timestamp
 	// detected newer than the one provided by the server
 	if s.Latest > timeStamp {
-		return errors.New("stale timestamp")
+		return ErrStaleTimestamp
 	}
 	s.Latest = timeStamp
 	return nil
@@ -321,8 +450,10 @@ func getHashFromPath(path string) string {
 // payload. There is an important set of steps that this goes through, including:
 // - validating the MultiHash in the URL is supported
 // - comparing the payload pubkey to the url hash, which must match.
-// if all verification and validations are successful, it returns the data bytes from the payload
+// if all verification and validations are successful, it returns the data bytes from the payload.
+// If a node answers that nothing was written yet and no other node has a payload, empty data is returned.
 func (s *hashmapStorage) getFirstSuccess() ([]byte, error) {
+	notFound := false
 	for _, node := range s.ReadNodes {
 		u, err := url.Parse(node.URL)
 		if err != nil {
@@ -338,6 +469,10 @@ func (s *hashmapStorage) getFirstSuccess() ([]byte, error) {
 			continue
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			notFound = true
+			continue
+		}
 
 		payload, err := hashmap.NewPayloadFromReader(resp.Body)
 		if err != nil {
@@ -362,7 +497,10 @@ func (s *hashmapStorage) getFirstSuccess() ([]byte, error) {
 		}
 		return data.MessageBytes()
 	}
-	return []byte{}, errors.New("no servers available")
+	if notFound {
+		return []byte{}, nil
+	}
+	return []byte{}, ErrNodesUnavailable
 }
 
 func (s *hashmapStorage) Get(key string) ([]byte, error) {
@@ -389,7 +527,7 @@ func (s *hashmapStorage) setFirstSuccess(payload []byte) error {
 		}
 		return nil
 	}
-	return errors.New("no servers available")
+	return ErrNodesUnavailable
 }
 
 func (s *hashmapStorage) Set(key string, value []byte) (string, error) {
@@ -427,6 +565,14 @@ func (s hashmapStorage) Close() (e error) { return }
 // share returns a peerStorage and error, it generates read nodes from the write nodes + pubkey
 // it also returns ReadRules based on the WriteRules
 func (s hashmapStorage) share() (peerStorage, error) {
+	// storage received from a peer has no signatures and is shared as is
+	if len(s.Signatures) == 0 {
+		return peerStorage{
+			Type:      HashmapEngine,
+			ReadNodes: s.ReadNodes,
+			ReadRule:  s.ReadRule,
+		}, nil
+	}
 	readNodes, err := s.genReadFromWriteNodes()
 	if err != nil {
 		return peerStorage{}, err
@@ -452,6 +598,21 @@ func (s hashmapStorage) export() (storageConfig, error) {
 	}, nil
 }
 
+// rotate returns a hashmapStorage that writes to the same nodes with a newly generated signing key
+func (s hashmapStorage) rotate() *hashmapStorage {
+	privateKey := hashmap.GenerateKey()
+	sig := signatureAlgorithm{
+		Type:       defaultHashmapSigType,
+		PrivateKey: privateKey,
+		PublicKey:  privateKey[32:],
+	}
+	return &hashmapStorage{
+		WriteNodes: s.WriteNodes,
+		WriteRule:  s.WriteRule,
+		Signatures: []signatureAlgorithm{sig},
+	}
+}
+
 // genReadFromWriteNodes creates a set of read nodes based on all signature
 // files times the number of write urls and returns a list of nodes and and error
 func (s hashmapStorage) genReadFromWriteNodes() ([]node, error) {
@@ -511,7 +672,7 @@ func (s *ipfsStorage) getFirstSuccess(hash string) ([]byte, error) {
 		}
 		return resp, nil
 	}
-	return []byte{}, errors.New("no servers available")
+	return []byte{}, ErrNodesUnavailable
 }
 
 func (s ipfsStorage) Set(key string, value []byte) (string, error) {
@@ -534,7 +695,7 @@ func (s ipfsStorage) setFirstSuccess(body []byte) (string, error) {
 		}
 		return resp, nil
 	}
-	return "", errors.New("no servers available")
+	return "", ErrNodesUnavailable
 }
 
 func (s ipfsStorage) Delete(key string) error            { return nil }
@@ -542,13 +703,31 @@ func (s ipfsStorage) List(path string) ([]string, error) { return []string{}, ni
 func (s ipfsStorage) Close() error                       { return nil }
 
 func (s ipfsStorage) share() (peerStorage, error) {
+	// storage received from a peer has no write nodes and is shared as is
+	if len(s.WriteNodes) == 0 {
+		return peerStorage{
+			Type:      IPFSEngine,
+			ReadNodes: s.ReadNodes,
+			ReadRule:  s.ReadRule,
+		}, nil
+	}
 	return peerStorage{
 		Type:      IPFSEngine,
-		ReadNodes: s.WriteNodes,
+		ReadNodes: shareNodes(s.WriteNodes),
 		ReadRule:  s.WriteRule,
 	}, nil
 }
 
+// shareNodes returns copies of nodes that are safe to share with a peer. Headers often hold the credentials of
+// a write node, so they are kept local and peers read without them.
+func shareNodes(nodes []node) []node {
+	var shared []node
+	for _, n := range nodes {
+		shared = append(shared, node{URL: n.URL, Settings: n.Settings})
+	}
+	return shared
+}
+
 // TODO: configure export settings for this
 func (s ipfsStorage) export() (storageConfig, error) {
 	return storageConfig{
@@ -641,6 +820,9 @@ func getFromIPFS(n node, hash string) ([]byte, error) {
 		}
 	}
 	resp, err := client.Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
 	defer resp.Body.Close()
 	limitedReader := &io.LimitedReader{R: resp.Body, N: maxIPFSRead}
 	return ioutil.ReadAll(limitedReader)
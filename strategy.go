@@ -1,6 +1,15 @@
 package handshake
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/nomasters/hashmap"
+	yaml "gopkg.in/yaml.v2"
+)
 
 type strategy struct {
 	Rendezvous storage
@@ -85,6 +94,16 @@ func (s strategy) ShareJSONBytes() ([]byte, error) {
 	return json.Marshal(config)
 }
 
+// withNewRendezvous returns a copy of the strategy whose rendezvous writes to a new endpoint
+func (s strategy) withNewRendezvous() (strategy, error) {
+	h, ok := s.Rendezvous.(*hashmapStorage)
+	if !ok || len(h.WriteNodes) == 0 {
+		return s, errors.New("rendezvous can not be rotated")
+	}
+	s.Rendezvous = h.rotate()
+	return s, nil
+}
+
 func newDefaultStrategy() strategy {
 	return strategy{
 		Rendezvous: newDefaultRendezvous(),
@@ -92,3 +111,192 @@ func newDefaultStrategy() strategy {
 		Cipher:     newDefaultCipher(),
 	}
 }
+
+// StrategyDefinition describes a strategy in a form that can be loaded from a YAML or JSON file. Node headers
+// are only sent by this device, they are never shared with peers, so a node whose reads require a header, such
+// as the credentials of the write node below, can not be read by peers.
+// For example:
+//
+//	rendezvous:
+//	  engine: hashmap
+//	  rule: first_success
+//	  nodes:
+//	    - url: https://prototype.hashmap.sh
+//	storage:
+//	  engine: ipfs
+//	  nodes:
+//	    - url: https://ipfs.example.com:5001/
+//	      settings:
+//	        query_type: api
+//	      header:
+//	        Authorization: Basic dXNlcjpwYXNz
+//	cipher:
+//	  type: secretbox
+//	  chunk_size: 16000
+type StrategyDefinition struct {
+	Rendezvous StorageDefinition `yaml:"rendezvous" json:"rendezvous"`
+	Storage    StorageDefinition `yaml:"storage" json:"storage"`
+	Cipher     CipherDefinition  `yaml:"cipher" json:"cipher"`
+}
+
+// StorageDefinition describes the engine, nodes and consensus rule of a storage in a StrategyDefinition
+type StorageDefinition struct {
+	Engine string           `yaml:"engine" json:"engine"`
+	Rule   string           `yaml:"rule,omitempty" json:"rule,omitempty"`
+	Nodes  []NodeDefinition `yaml:"nodes" json:"nodes"`
+}
+
+// NodeDefinition describes a single storage endpoint in a StorageDefinition
+type NodeDefinition struct {
+	URL      string            `yaml:"url" json:"url"`
+	Header   map[string]string `yaml:"header,omitempty" json:"header,omitempty"`
+	Settings map[string]string `yaml:"settings,omitempty" json:"settings,omitempty"`
+}
+
+// CipherDefinition describes the cipher of a StrategyDefinition
+type CipherDefinition struct {
+	Type      string `yaml:"type" json:"type"`
+	ChunkSize int    `yaml:"chunk_size,omitempty" json:"chunk_size,omitempty"`
+}
+
+// NewStrategyDefinitionFromFile reads a YAML or JSON encoded StrategyDefinition from path and validates it
+func NewStrategyDefinitionFromFile(path string) (StrategyDefinition, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return StrategyDefinition{}, err
+	}
+	return ParseStrategyDefinition(b)
+}
+
+// ParseStrategyDefinition takes YAML or JSON encoded bytes and returns a validated StrategyDefinition and error
+func ParseStrategyDefinition(b []byte) (StrategyDefinition, error) {
+	var def StrategyDefinition
+	// JSON is a subset of YAML, so the yaml decoder handles both formats
+	if err := yaml.UnmarshalStrict(b, &def); err != nil {
+		return StrategyDefinition{}, err
+	}
+	if err := def.validate(); err != nil {
+		return StrategyDefinition{}, err
+	}
+	return def, nil
+}
+
+// validate checks the engines, nodes, consensus rules and cipher of the definition
+func (d StrategyDefinition) validate() error {
+	rendezvousEngine, err := storageEngineFromString(d.Rendezvous.Engine)
+	if err != nil {
+		return err
+	}
+	if rendezvousEngine != HashmapEngine {
+		return errors.New("rendezvous engine must be hashmap")
+	}
+	storageEngine, err := storageEngineFromString(d.Storage.Engine)
+	if err != nil {
+		return err
+	}
+	if storageEngine != IPFSEngine {
+		return errors.New("storage engine must be ipfs")
+	}
+	if _, err := d.Rendezvous.storageOptions(); err != nil {
+		return fmt.Errorf("rendezvous: %w", err)
+	}
+	if _, err := d.Storage.storageOptions(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	_, err = d.Cipher.cipher()
+	return err
+}
+
+// strategy converts the definition into a strategy. A new signing key is generated for the rendezvous.
+func (d StrategyDefinition) strategy() (s strategy, err error) {
+	if err = d.validate(); err != nil {
+		return
+	}
+	rendezvousOpts, err := d.Rendezvous.storageOptions()
+	if err != nil {
+		return s, fmt.Errorf("rendezvous: %w", err)
+	}
+	privateKey := hashmap.GenerateKey()
+	rendezvousOpts.Signatures = []signatureAlgorithm{
+		{
+			Type:       defaultHashmapSigType,
+			PrivateKey: privateKey,
+			PublicKey:  privateKey[32:],
+		},
+	}
+	if s.Rendezvous, err = newHashmapStorage(rendezvousOpts); err != nil {
+		return
+	}
+	storageOpts, err := d.Storage.storageOptions()
+	if err != nil {
+		return s, fmt.Errorf("storage: %w", err)
+	}
+	if s.Storage, err = newIPFSStorage(storageOpts); err != nil {
+		return
+	}
+	s.Cipher, err = d.Cipher.cipher()
+	return
+}
+
+// storageOptions returns write-side StorageOptions for the definition. The rule is shared with peers as their read
+// rule, so it must be implemented for both reading and writing.
+func (d StorageDefinition) storageOptions() (opts StorageOptions, err error) {
+	if len(d.Nodes) < 1 {
+		return opts, errors.New("at least one node is required")
+	}
+	if opts.WriteRule, err = consensusRuleFromString(d.Rule); err != nil {
+		return
+	}
+	for _, n := range d.Nodes {
+		if n.URL == "" {
+			return opts, errors.New("node url is required")
+		}
+		if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return opts, fmt.Errorf("invalid node url: %v", n.URL)
+		}
+		opts.WriteNodes = append(opts.WriteNodes, node{
+			URL:      n.URL,
+			Header:   n.Header,
+			Settings: n.Settings,
+		})
+	}
+	return opts, nil
+}
+
+func (d CipherDefinition) cipher() (cipher, error) {
+	switch d.Type {
+	case "", "secretbox":
+		c := newDefaultSBCipher()
+		if d.ChunkSize < 0 {
+			return nil, errors.New("cipher chunk_size must be positive")
+		}
+		if d.ChunkSize > 0 {
+			c.ChunkSize = d.ChunkSize
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher type: %v", d.Type)
+	}
+}
+
+func storageEngineFromString(s string) (StorageEngine, error) {
+	switch s {
+	case "hashmap":
+		return HashmapEngine, nil
+	case "ipfs":
+		return IPFSEngine, nil
+	default:
+		return 0, fmt.Errorf("unsupported storage engine: %v", s)
+	}
+}
+
+func consensusRuleFromString(s string) (consensusRule, error) {
+	switch s {
+	case "", "first_success":
+		return firstSuccess, nil
+	case "redundant_pair_success", "majority_success", "unanimous_success":
+		return 0, fmt.Errorf("consensus rule %v is not implemented yet", s)
+	default:
+		return 0, fmt.Errorf("unsupported consensus rule: %v", s)
+	}
+}
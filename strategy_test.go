@@ -64,3 +64,86 @@ func TestExportStrategy(t *testing.T) {
 	}
 	t.Log(string(stratJson))
 }
+
+func TestParseStrategyDefinition(t *testing.T) {
+	yamlDef := []byte(`
+rendezvous:
+  engine: hashmap
+  nodes:
+    - url: https://prototype.hashmap.sh
+storage:
+  engine: ipfs
+  rule: first_success
+  nodes:
+    - url: https://ipfs.example.com:5001/
+      settings:
+        query_type: api
+      header:
+        Authorization: Basic dXNlcjpwYXNz
+cipher:
+  type: secretbox
+  chunk_size: 8000
+`)
+	def, err := ParseStrategyDefinition(yamlDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strat, err := def.strategy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := strat.Share()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Cipher.ChunkSize != 8000 {
+		t.Errorf("expected chunk size 8000, got %v", config.Cipher.ChunkSize)
+	}
+	if len(config.Rendezvous.ReadNodes) != 1 {
+		t.Errorf("expected 1 rendezvous read node, got %v", len(config.Rendezvous.ReadNodes))
+	}
+	if len(config.Storage.ReadNodes) != 1 || config.Storage.ReadNodes[0].Header != nil {
+		t.Errorf("expected 1 storage read node without headers, got %+v", config.Storage.ReadNodes)
+	}
+	exported, err := strat.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Storage.WriteNodes[0].Header["Authorization"] == "" {
+		t.Error("expected exported write node to keep its headers")
+	}
+
+	jsonDef := []byte(`{
+		"rendezvous": {"engine": "hashmap", "nodes": [{"url": "https://prototype.hashmap.sh"}]},
+		"storage": {"engine": "ipfs", "nodes": [{"url": "https://cloudflare-ipfs.com"}]}
+	}`)
+	if _, err := ParseStrategyDefinition(jsonDef); err != nil {
+		t.Error(err)
+	}
+
+	invalid := []byte(`{"rendezvous": {"engine": "ipfs"}, "storage": {"engine": "ipfs"}}`)
+	if _, err := ParseStrategyDefinition(invalid); err == nil {
+		t.Error("expected an ipfs rendezvous to be rejected")
+	}
+
+	rejected := map[string]string{
+		"an unimplemented consensus rule": `{
+			"rendezvous": {"engine": "hashmap", "rule": "majority_success", "nodes": [{"url": "https://prototype.hashmap.sh"}]},
+			"storage": {"engine": "ipfs", "nodes": [{"url": "https://cloudflare-ipfs.com"}]}
+		}`,
+		"a node url without a scheme": `{
+			"rendezvous": {"engine": "hashmap", "nodes": [{"url": "https://prototype.hashmap.sh"}]},
+			"storage": {"engine": "ipfs", "nodes": [{"url": "cloudflare-ipfs.com"}]}
+		}`,
+		"an unsupported cipher": `{
+			"rendezvous": {"engine": "hashmap", "nodes": [{"url": "https://prototype.hashmap.sh"}]},
+			"storage": {"engine": "ipfs", "nodes": [{"url": "https://cloudflare-ipfs.com"}]},
+			"cipher": {"type": "aes"}
+		}`,
+	}
+	for name, def := range rejected {
+		if _, err := ParseStrategyDefinition([]byte(def)); err == nil {
+			t.Errorf("expected %v to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nomasters/hashmap"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testNetwork is an in-memory stand-in for a hashmap server and an IPFS API node
+type testNetwork struct {
+	sync.Mutex
+	server  *httptest.Server
+	payload map[string][]byte
+	blocks  map[string][]byte
+	offline bool
+}
+
+// newTestNetwork starts a testNetwork, which must be closed by the caller
+func newTestNetwork() *testNetwork {
+	n := &testNetwork{
+		payload: make(map[string][]byte),
+		blocks:  make(map[string][]byte),
+	}
+	n.server = httptest.NewServer(http.HandlerFunc(n.handle))
+	return n
+}
+
+func (n *testNetwork) Close() {
+	n.server.Close()
+}
+
+// setOffline makes every request fail with a server error until it is set back to false
+func (n *testNetwork) setOffline(offline bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.offline = offline
+}
+
+// strategy returns a StrategyDefinition that uses the testNetwork for rendezvous and storage
+func (n *testNetwork) strategy() StrategyDefinition {
+	return StrategyDefinition{
+		Rendezvous: StorageDefinition{
+			Engine: "hashmap",
+			Nodes:  []NodeDefinition{{URL: n.server.URL}},
+		},
+		Storage: StorageDefinition{
+			Engine: "ipfs",
+			Nodes: []NodeDefinition{{
+				URL:      n.server.URL,
+				Settings: map[string]string{"query_type": "api"},
+			}},
+		},
+	}
+}
+
+func (n *testNetwork) handle(w http.ResponseWriter, r *http.Request) {
+	n.Lock()
+	defer n.Unlock()
+	if n.offline {
+		http.Error(w, "offline", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/v0/add":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		sum := blake2b.Sum256(b)
+		hash := hex.EncodeToString(sum[:])
+		n.blocks[hash] = b
+		json.NewEncoder(w).Encode(map[string]string{"Hash": hash})
+	case r.URL.Path == "/api/v0/cat":
+		b, ok := n.blocks[r.URL.Query().Get("arg")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case r.Method == http.MethodPost:
+		b, _ := ioutil.ReadAll(r.Body)
+		p, err := hashmap.NewPayloadFromReader(bytes.NewReader(b))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pubkey, err := p.PubKeyBytes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.payload[base58Multihash(pubkey)] = b
+	default:
+		b, ok := n.payload[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}
+}
+
+// newTestChat runs a handshake between an initiator and a peer using the testNetwork strategy and
+// returns their chat IDs
+func newTestChat(t *testing.T, n *testNetwork, initiatorSession, peerSession *Session) (string, string) {
+	if err := initiatorSession.NewInitiator(n.strategy()); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerSession.NewPeer(n.strategy()); err != nil {
+		t.Fatal(err)
+	}
+	share, err := peerSession.ShareHandshakePosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initiatorSession.AddPeerToHandshake(share); err != nil {
+		t.Fatal(err)
+	}
+	initiatorShare, err := initiatorSession.GetHandshakePeerConfig(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peerSession.AddPeerToHandshake(initiatorShare); err != nil {
+		t.Fatal(err)
+	}
+	initiatorChatID, err := initiatorSession.NewChat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerChatID, err := peerSession.NewChat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiatorChatID, peerChatID
+}
+
+// messagesIn returns the message bodies found in a json encoded chatLogList
+func messagesIn(t *testing.T, b []byte) []string {
+	var entries []Message
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, e := range entries {
+		if e.Data.Message != "" {
+			messages = append(messages, e.Data.Message)
+		}
+	}
+	return messages
+}
+
+func removeTestDBs(paths ...string) {
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
@@ -0,0 +1,172 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// tokenKeyPrefix is the storage prefix of session tokens, stored under tokens/<profileID>/<tokenID>
+	tokenKeyPrefix = "tokens/"
+	tokenLength    = 32
+)
+
+// sessionToken is the profile stored for a token created by CreateSessionToken, encrypted with a key derived
+// from the token
+type sessionToken struct {
+	Profile Profile
+	Expires int64
+}
+
+// CreateSessionToken returns a random token that opens the session profile with NewSessionFromToken for ttl
+// seconds, or until it is revoked with RevokeSessionToken. The token does not reveal the password and can not be
+// used to change it. It holds the profile key, so it stops working once the key is rotated.
+func (s *Session) CreateSessionToken(ttl int64) (string, error) {
+	if err := s.checkSession(); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", errors.New("token ttl must be greater than 0")
+	}
+	profile, err := s.GetProfile()
+	if err != nil {
+		return "", err
+	}
+	token := genRandBytes(tokenLength)
+	defer wipeBytes(token)
+	t := sessionToken{
+		Profile: profile,
+		Expires: time.Now().Unix() + ttl,
+	}
+	tokenGob, err := encodeGob(t)
+	if err != nil {
+		return "", err
+	}
+	defer wipeBytes(tokenGob)
+	key, id := tokenSecrets(token)
+	defer wipeBytes(key)
+	encrypted, err := s.cipher.Encrypt(tokenGob, key)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.storage.Set(tokenKeyPrefix+t.Profile.ID+"/"+id, encrypted); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// NewSessionFromToken takes a token created by CreateSessionToken and opts and returns a pointer to a Session of
+// the profile the token was created for. An expired token is securely deleted and ErrSessionExpired is returned.
+func NewSessionFromToken(token string, opts SessionOptions) (*Session, error) {
+	storage, err := newStorage(StorageOptions{Engine: opts.StorageEngine, FilePath: opts.StorageFilePath})
+	if err != nil {
+		return nil, err
+	}
+	session, err := newSessionFromToken(token, storage)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func newSessionFromToken(token string, storage storage) (*Session, error) {
+	path, key, err := findToken(token, storage)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+	encrypted, err := storage.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	cipher := newTimeSeriesSBCipher()
+	tokenGob, err := cipher.Decrypt(encrypted, key)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	defer wipeBytes(tokenGob)
+	var t sessionToken
+	if err := gob.NewDecoder(bytes.NewBuffer(tokenGob)).Decode(&t); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > t.Expires {
+		wipeBytes(t.Profile.Key)
+		if err := secureDelete(storage, path); err != nil {
+			return nil, err
+		}
+		return nil, ErrSessionExpired
+	}
+	g, err := getGlobalConfig(storage)
+	if err != nil {
+		return nil, err
+	}
+	session := Session{
+		storage:      storage,
+		cipher:       cipher,
+		ttl:          DefaultSessionTTL,
+		startTime:    time.Now().Unix(),
+		globalConfig: g,
+	}
+	session.setProfile(t.Profile)
+	if err := session.expireHandshake(); err != nil {
+		session.wipeKey()
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RevokeSessionToken takes a token created by CreateSessionToken and opts and securely deletes the token, so it
+// no longer opens a session. Revoking an unknown token is not an error.
+func RevokeSessionToken(token string, opts SessionOptions) error {
+	storage, err := newStorage(StorageOptions{Engine: opts.StorageEngine, FilePath: opts.StorageFilePath})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	path, key, err := findToken(token, storage)
+	if errors.Is(err, ErrInvalidToken) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wipeBytes(key)
+	return secureDelete(storage, path)
+}
+
+// findToken returns the storage key of token and the key it is encrypted with, or ErrInvalidToken if it is not
+// in storage
+func findToken(token string, storage storage) (string, []byte, error) {
+	b, err := hex.DecodeString(token)
+	if err != nil || len(b) != tokenLength {
+		return "", nil, ErrInvalidToken
+	}
+	defer wipeBytes(b)
+	key, id := tokenSecrets(b)
+	paths, err := storage.List(tokenKeyPrefix)
+	if err != nil {
+		wipeBytes(key)
+		return "", nil, err
+	}
+	for _, path := range paths {
+		if strings.HasSuffix(path, "/"+id) {
+			return path, key, nil
+		}
+	}
+	wipeBytes(key)
+	return "", nil, ErrInvalidToken
+}
+
+// tokenSecrets derives the encryption key and the storage ID of token
+func tokenSecrets(token []byte) (key []byte, id string) {
+	k := blake2b.Sum256(append([]byte("handshake token key"), token...))
+	i := blake2b.Sum256(append([]byte("handshake token id"), token...))
+	return k[:], hex.EncodeToString(i[:16])
+}
@@ -0,0 +1,82 @@
+package handshake
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	storagePath := "session-token.boltdb"
+	defer os.Remove(storagePath)
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+
+	s := newTestSession(t, storagePath, "password")
+	chatKey := fmt.Sprintf("chats/abc/%v/config", s.profile.ID)
+	if _, err := s.set(chatKey, []byte("chat config")); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.CreateSessionToken(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.CreateSessionToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profileID := s.profile.ID
+	s.Close()
+
+	s, err = NewSessionFromToken(token, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.profileID() != profileID {
+		t.Error("expected the token to open the profile it was created for")
+	}
+	if value, err := s.get(chatKey); err != nil || string(value) != "chat config" {
+		t.Errorf("expected the chat to be readable, got %q, %v", value, err)
+	}
+	if err := s.ChangePassword("wrong", "new_password"); err == nil {
+		t.Error("expected the token not to change the password without the old one")
+	}
+	s.Close()
+
+	if _, err := NewSessionFromToken(hex.EncodeToString(genRandBytes(tokenLength)), opts); err != ErrInvalidToken {
+		t.Errorf("expected %v for an unknown token, got %v", ErrInvalidToken, err)
+	}
+	time.Sleep(2 * time.Second)
+	if _, err := NewSessionFromToken(expired, opts); err != ErrSessionExpired {
+		t.Errorf("expected %v for an expired token, got %v", ErrSessionExpired, err)
+	}
+	if _, err := NewSessionFromToken(expired, opts); err != ErrInvalidToken {
+		t.Errorf("expected the expired token to be deleted, got %v", err)
+	}
+	if err := RevokeSessionToken(token, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSessionFromToken(token, opts); err != ErrInvalidToken {
+		t.Errorf("expected %v for a revoked token, got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestRotateProfileKeyRevokesTokens(t *testing.T) {
+	storagePath := "rotate-token.boltdb"
+	defer os.Remove(storagePath)
+	opts := SessionOptions{StorageEngine: BoltEngine, StorageFilePath: storagePath}
+
+	s := newTestSession(t, storagePath, "password")
+	token, err := s.CreateSessionToken(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RotateProfileKey("password"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := NewSessionFromToken(token, opts); err != ErrInvalidToken {
+		t.Errorf("expected the token to be revoked by the rotation, got %v", err)
+	}
+}
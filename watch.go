@@ -0,0 +1,232 @@
+package handshake
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// DefaultWatchInterval is the default time between checks for new messages
+	DefaultWatchInterval = 30 * time.Second
+	// DefaultWatchMaxInterval is the longest time between checks once Watch backs off
+	DefaultWatchMaxInterval = 10 * time.Minute
+	// DefaultWatchJitter is the default fraction of the interval that is randomized
+	DefaultWatchJitter = 0.5
+)
+
+// WatchOptions configures the polling schedule of Watch. Zero values are replaced with defaults.
+type WatchOptions struct {
+	// Interval is the time between checks while new messages arrive
+	Interval time.Duration
+	// MaxInterval caps the interval, which doubles after every check without new messages
+	MaxInterval time.Duration
+	// Jitter is the fraction of the interval, between 0 and 1, that is added or removed at random
+	Jitter float64
+	// KeepAlive restarts the session TTL before every round of checks, so the session does not expire while
+	// Watch runs
+	KeepAlive bool
+	// ReleaseStorage closes the storage file with ReleaseStorage after every round of checks, so other processes
+	// can use the data dir while Watch waits. Session calls made in the meantime open it again.
+	ReleaseStorage bool
+}
+
+// WatchEvent holds the new messages of a chat found by Watch and the error of the check, if any. An error that
+// is not ErrSessionExpired only affects that check, Messages may still hold what other peers had.
+type WatchEvent struct {
+	ChatID   string
+	Messages []Message
+	Err      error
+}
+
+func (o WatchOptions) withDefaults() WatchOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultWatchInterval
+	}
+	if o.MaxInterval < o.Interval {
+		o.MaxInterval = DefaultWatchMaxInterval
+		if o.MaxInterval < o.Interval {
+			o.MaxInterval = o.Interval
+		}
+	}
+	if o.Jitter <= 0 || o.Jitter > 1 {
+		o.Jitter = DefaultWatchJitter
+	}
+	return o
+}
+
+// jittered returns d with a random offset of up to jitter*d in either direction
+func jittered(d time.Duration, jitter float64) time.Duration {
+	spread := int64(float64(d) * jitter)
+	if spread <= 0 {
+		return d
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(2*spread))
+	if err != nil {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(n.Int64())
+}
+
+// Watch polls the rendezvous points of the peers of chatID, or of every chat if chatID is empty, and sends new
+// chat log entries on the returned channel. Messages in the outbox of a chat are sent before it is checked, and
+// chats joined while watching are picked up every round. Checks are spaced by a randomized interval that doubles
+// while no new messages arrive, and the order of the chats is shuffled every round, so the polling pattern is hard
+// to fingerprint. Failed checks are sent as events with Err set and retried the next round. Unless opts.KeepAlive
+// is set, the caller must Touch or Unlock the session before its TTL passes. The channel is closed when ctx is
+// done or the session expires, in which case a final event holds ErrSessionExpired.
+func (s *Session) Watch(ctx context.Context, chatID string, opts WatchOptions) (<-chan WatchEvent, error) {
+	opts = opts.withDefaults()
+	seen := make(map[string]map[string]bool)
+	chatIDs, err := s.watchedChats(chatID, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		// send delivers e and reports whether Watch should go on
+		send := func(e WatchEvent) bool {
+			select {
+			case events <- e:
+				return !errors.Is(e.Err, ErrSessionExpired)
+			case <-ctx.Done():
+				return false
+			}
+		}
+		interval := opts.Interval
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			if opts.KeepAlive {
+				if err := s.Touch(); err != nil {
+					send(WatchEvent{Err: err})
+					return
+				}
+			}
+			ids, err := s.watchedChats(chatID, seen)
+			if err == nil {
+				chatIDs = ids
+			} else if !send(WatchEvent{Err: err}) {
+				return
+			}
+			found := false
+			for _, i := range shuffledIndexes(len(chatIDs)) {
+				id := chatIDs[i]
+				messages, err := s.retrieveNewMessages(id, seen[id])
+				if err == nil && len(messages) == 0 {
+					continue
+				}
+				found = found || len(messages) > 0
+				if !send(WatchEvent{ChatID: id, Messages: messages, Err: err}) {
+					return
+				}
+			}
+			if found {
+				interval = opts.Interval
+			} else if interval *= 2; interval > opts.MaxInterval {
+				interval = opts.MaxInterval
+			}
+			if opts.ReleaseStorage {
+				if err := s.ReleaseStorage(); err != nil && !send(WatchEvent{Err: err}) {
+					return
+				}
+			}
+			timer.Reset(jittered(interval, opts.Jitter))
+		}
+	}()
+	return events, nil
+}
+
+// watchedChats returns chatID, or every chat of the profile if it is empty. The entries of chats that are new to
+// seen are added to it, so only messages that arrive later are reported, and chats that were deleted are removed.
+func (s *Session) watchedChats(chatID string, seen map[string]map[string]bool) ([]string, error) {
+	chatIDs := []string{chatID}
+	if chatID == "" {
+		ids, err := s.chatIDs()
+		if err != nil {
+			return nil, err
+		}
+		chatIDs = ids
+	}
+	current := make(map[string]bool)
+	for _, id := range chatIDs {
+		current[id] = true
+		if seen[id] != nil {
+			continue
+		}
+		// a chat that is being created is locked until it is complete
+		unlock := s.lockChat(id)
+		cl, err := s.GetChatlog(id)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+		seen[id] = make(map[string]bool)
+		for _, e := range cl {
+			seen[id][e.ID] = true
+		}
+	}
+	for id := range seen {
+		if !current[id] {
+			delete(seen, id)
+		}
+	}
+	return chatIDs, nil
+}
+
+// retrieveNewMessages sends the messages in the outbox of chatID, checks its peers and returns the sorted
+// messages that are not in seen, adding them to it. Pending messages are left out until they are sent. The
+// error is the first failure of the outbox or of a peer, the messages found are returned with it.
+func (s *Session) retrieveNewMessages(chatID string, seen map[string]bool) ([]Message, error) {
+	// messages that still can't be sent stay in the outbox for the next round
+	_, flushErr := s.FlushOutbox(chatID)
+	if errors.Is(flushErr, ErrSessionExpired) {
+		return nil, flushErr
+	}
+	report, err := s.RetrieveReport(chatID)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, m := range report.Messages {
+		if !m.Pending && !seen[m.ID] {
+			seen[m.ID] = true
+			messages = append(messages, m)
+		}
+	}
+	if flushErr != nil {
+		return messages, flushErr
+	}
+	for _, p := range report.Peers {
+		if p.Err != nil {
+			return messages, fmt.Errorf("%v: %w", p.Alias, p.Err)
+		}
+	}
+	return messages, nil
+}
+
+// shuffledIndexes returns the numbers 0 to n-1 in random order
+func shuffledIndexes(n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			continue
+		}
+		indexes[i], indexes[j.Int64()] = indexes[j.Int64()], indexes[i]
+	}
+	return indexes
+}
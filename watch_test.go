@@ -0,0 +1,133 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jittered(time.Second, 0.5)
+		if d < 500*time.Millisecond || d >= 1500*time.Millisecond {
+			t.Fatalf("jittered interval %v out of range", d)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-watch.boltdb", "bob-watch.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "before watching"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.RetrieveMessages(aliceChatID); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := alice.Watch(ctx, "", WatchOptions{Interval: 50 * time.Millisecond, MaxInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is not used by the test while the watch runs, so bob sends from his own session
+	if _, err := bob.SendMessage(bobChatID, []byte(`{"message": "while watching"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-events:
+		if e.Err != nil {
+			t.Fatal(e.Err)
+		}
+		if e.ChatID != aliceChatID || len(e.Messages) != 1 || e.Messages[0].Data.Message != "while watching" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchNewChatsAndErrors(t *testing.T) {
+	defer func(delay time.Duration) { sendRetryDelay = delay }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	n := newTestNetwork()
+	defer n.Close()
+	paths := []string{"alice-watch-new.boltdb", "bob-watch-new.boltdb"}
+	defer removeTestDBs(paths...)
+
+	alice := newTestSession(t, paths[0], "alice_password")
+	defer alice.Close()
+	bob := newTestSession(t, paths[1], "bob_password")
+	defer bob.Close()
+	// without KeepAlive the session would expire while watching
+	alice.mu.Lock()
+	alice.ttl = 3
+	alice.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := WatchOptions{Interval: 50 * time.Millisecond, MaxInterval: 100 * time.Millisecond, KeepAlive: true, ReleaseStorage: true}
+	events, err := alice.Watch(ctx, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() WatchEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			if errors.Is(e.Err, ErrSessionExpired) {
+				t.Fatal(e.Err)
+			}
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("no event received")
+		}
+		return WatchEvent{}
+	}
+
+	aliceChatID, bobChatID := newTestChat(t, n, alice, bob)
+	if _, err := bob.Send(bobChatID, MessageData{Message: "new chat"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Err != nil || e.ChatID != aliceChatID || len(e.Messages) != 1 {
+		t.Fatalf("expected the message of the new chat, got %+v", e)
+	}
+
+	n.setOffline(true)
+	if e := next(); e.Err == nil || e.ChatID != aliceChatID {
+		t.Fatalf("expected the failed check to be reported, got %+v", e)
+	}
+	n.setOffline(false)
+	if _, err := bob.Send(bobChatID, MessageData{Message: "back online"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		e := next()
+		if len(e.Messages) == 1 && e.Messages[0].Data.Message == "back online" {
+			break
+		}
+	}
+	cancel()
+	for range events {
+	}
+	if _, err := alice.GetProfile(); err != nil {
+		t.Error("expected KeepAlive to keep the session unlocked")
+	}
+}